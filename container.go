@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -18,25 +19,49 @@ import (
 	"github.com/docker/docker/api/types/network"
 	docker "github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
 
 	"github.com/sensiblecodeio/barrier"
 	"github.com/sensiblecodeio/hanoverd/pkg/source"
 )
 
 type Container struct {
-	Name      string
-	ImageName string
-	Args, Env []string
-	Volumes   []string
-	Mounts    []mount.Mount
-	StatusURI string
-
-	client        *docker.Client
-	containerID   string
+	Name       string
+	Generation int // -1 for a fallback container
+	Fallback   bool
+	ImageName  string
+	SHA        string
+	Args, Env  []string
+	Volumes    []string
+	Mounts     []mount.Mount
+	// Published ports, whose mapped ports are bound to the same host IP.
+	PortBindings nat.PortMap
+	StatusURI    string
+	// Sent to UDP ports to determine readiness, if set.
+	UDPProbe []byte
+
+	client      *docker.Client
+	containerID string
+
+	// containerInfo is set by Start, and read by hooks on other goroutines.
+	infoMu        sync.Mutex
 	containerInfo types.ContainerJSON
+	// Extra environment from the image source, e.g. HANOVERD_IMAGE_VERSION.
+	imageEnv []string
 
 	Failed, Superceded, Obtained, Ready, Closing barrier.Barrier
 
+	// Live falls once the container is receiving live traffic.
+	Live barrier.Barrier
+	// Exited falls once Run has returned.
+	Exited barrier.Barrier
+
+	// Times at which the container reached each stage, for reporting.
+	Started, ObtainedAt, ReadyAt, LiveAt time.Time
+
+	failureMu sync.Mutex
+	failure   error
+
 	wg *sync.WaitGroup
 
 	Errors  <-chan error
@@ -55,6 +80,7 @@ func NewContainer(client *docker.Client, name string, wg *sync.WaitGroup) *Conta
 		wg:      wg,
 		Errors:  errors,
 		errorsW: errors,
+		Started: time.Now(),
 	}
 
 	// If the container fails we should assume it should be torn down.
@@ -85,6 +111,21 @@ func makeBinds(in []string) []string {
 	return binds
 }
 
+// makeMappedBindings returns bindings of the container ports in `published`
+// to ports of docker's choosing on the same host IPs, so that a mapped port is
+// no more reachable than the published port redirected to it.
+func makeMappedBindings(published nat.PortMap) (nat.PortSet, nat.PortMap) {
+	exposed := nat.PortSet{}
+	mapped := nat.PortMap{}
+	for port, bindings := range published {
+		exposed[port] = struct{}{}
+		for _, binding := range bindings {
+			mapped[port] = append(mapped[port], nat.PortBinding{HostIP: binding.HostIP})
+		}
+	}
+	return exposed, mapped
+}
+
 // `docker create` the container.
 func (c *Container) Create(imageName string) error {
 	// Inject internal environment variables
@@ -94,6 +135,9 @@ func (c *Container) Create(imageName string) error {
 		"HANOVERD_IMAGE_REPO=" + imageRepo,
 		"HANOVERD_IMAGE_TAGDIGEST=" + imageTagDigest,
 	}
+	internalEnv = append(internalEnv, c.imageEnv...)
+
+	exposedPorts, portBindings := makeMappedBindings(c.PortBindings)
 
 	resp, err := c.client.ContainerCreate(
 		context.TODO(),
@@ -104,6 +148,7 @@ func (c *Container) Create(imageName string) error {
 			Env:          append(internalEnv, c.Env...),
 			Cmd:          c.Args,
 			Image:        imageName,
+			ExposedPorts: exposedPorts,
 			Volumes:      makeVolumeSet(c.Volumes),
 			Labels: map[string]string{
 				"orchestrator":  "hanoverd",
@@ -112,6 +157,7 @@ func (c *Container) Create(imageName string) error {
 		},
 		&container.HostConfig{
 			PublishAllPorts: true,
+			PortBindings:    portBindings,
 			Binds:           makeBinds(c.Volumes),
 			AutoRemove:      true,
 			Mounts:          c.Mounts,
@@ -154,10 +200,12 @@ func (c *Container) CopyOutput() error {
 
 // AwaitListening polls for the program inside the container being ready to accept
 // connections.
+// TCP ports are polled with HTTP requests to the StatusURI. UDP ports are only
+// polled if UDPProbe is set, in which case any reply to it counts as success.
 // Returns `true` for success and `false` for failure.
 func (c *Container) AwaitListening() error {
 
-	if len(c.containerInfo.NetworkSettings.Ports) == 0 {
+	if len(c.Ports()) == 0 {
 		return fmt.Errorf("no ports are exposed (specify EXPOSE in Dockerfile)")
 	}
 
@@ -170,6 +218,20 @@ func (c *Container) AwaitListening() error {
 	finished := make(chan struct{})
 	defer close(finished)
 
+	// Protocol: a poller must not return before success
+	// has been acknowledged, otherwise we may hit
+	// noPollersRemain.
+	succeed := func() {
+		response := make(chan struct{})
+		select {
+		case success <- response:
+			<-response
+		case <-finished:
+			// Something else caused success/failure,
+			// we'll never be able to communicate success.
+		}
+	}
+
 	// Poll the statusURL once.
 	// Returns true if polling should continue and false otherwise.
 	poll := func(statusURL string) bool {
@@ -200,17 +262,7 @@ func (c *Container) AwaitListening() error {
 		}
 		switch resp.StatusCode {
 		case http.StatusOK:
-			// Protocol: poll() must not return before success
-			// has been acknowledged, otherwise we may hit
-			// noPollersRemain.
-			response := make(chan struct{})
-			select {
-			case success <- response:
-				<-response
-			case <-finished:
-				// Something else caused success/failure,
-				// we'll never be able to communicate success.
-			}
+			succeed()
 			return false
 
 		default:
@@ -218,16 +270,67 @@ func (c *Container) AwaitListening() error {
 				statusURL, resp.Status)
 			return false
 		}
+	}
+
+	// Send the UDPProbe to addr once.
+	// Returns true if polling should continue and false otherwise.
+	pollUDP := func(addr string) bool {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			log.Printf("Warning, unable to probe %q: %v", addr, err)
+			return false
+		}
+		defer conn.Close()
+
+		_, err = conn.Write(c.UDPProbe)
+		if err != nil {
+			return true
+		}
+
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second / PollFrequency))
+		_, err = conn.Read(make([]byte, 1))
+		if err != nil {
+			// No reply (yet), or ICMP port unreachable.
+			return true
+		}
 
-		return true
+		succeed()
+		return false
 	}
 
 	var pollers sync.WaitGroup
+	udpOnly := true
+
+	// Poll over IPv6 only if the container doesn't have an IPv4 address.
+	ipv4, _ := c.IPAddresses()
+	wantIPv6 := ipv4 == ""
 
 	// Start one poller per exposed port.
-	for _, portMaps := range c.containerInfo.NetworkSettings.Ports {
+	for privatePort, portMaps := range c.Ports() {
+		if len(portMaps) == 0 {
+			continue
+		}
 		port := portMaps[0] // take the first public port
-		statusURL := fmt.Sprint("http://", port.HostIP, ":", port.HostPort, c.StatusURI)
+		for _, p := range portMaps {
+			if strings.Contains(p.HostIP, ":") == wantIPv6 {
+				port = p
+				break
+			}
+		}
+		address := net.JoinHostPort(port.HostIP, port.HostPort)
+
+		var pollOnce func() bool
+		switch privatePort.Proto() {
+		case "udp":
+			if c.UDPProbe == nil {
+				continue
+			}
+			pollOnce = func() bool { return pollUDP(address) }
+		default:
+			udpOnly = false
+			statusURL := fmt.Sprint("http://", address, c.StatusURI)
+			pollOnce = func() bool { return poll(statusURL) }
+		}
 
 		c.wg.Add(1)
 		pollers.Add(1)
@@ -236,10 +339,10 @@ func (c *Container) AwaitListening() error {
 			defer pollers.Done()
 
 			// Poll until:
-			// * 200 status code
+			// * success
 			// * malformed response
 			// * teardown
-			for poll(statusURL) {
+			for pollOnce() {
 				select {
 				case <-finished:
 					return
@@ -249,6 +352,11 @@ func (c *Container) AwaitListening() error {
 		}()
 	}
 
+	if udpOnly && c.UDPProbe == nil {
+		// Nothing we can check, assume that starting is good enough.
+		return nil
+	}
+
 	noPollersRemain := make(chan struct{})
 	go func() {
 		defer close(noPollersRemain)
@@ -271,19 +379,52 @@ func (c *Container) AwaitListening() error {
 	}
 }
 
+// networkSettings returns the container's network settings, which are nil
+// until it has started.
+func (c *Container) networkSettings() *types.NetworkSettings {
+	c.infoMu.Lock()
+	defer c.infoMu.Unlock()
+	return c.containerInfo.NetworkSettings
+}
+
+// Ports returns the container's port mappings, which are empty until it has
+// started.
+func (c *Container) Ports() nat.PortMap {
+	settings := c.networkSettings()
+	if settings == nil {
+		return nil
+	}
+	return settings.Ports
+}
+
+// IPAddresses returns the container's IPv4 and IPv6 addresses. Either may be
+// blank.
+func (c *Container) IPAddresses() (ipv4, ipv6 string) {
+	settings := c.networkSettings()
+	if settings == nil {
+		return "", ""
+	}
+	ipv4, ipv6 = settings.IPAddress, settings.GlobalIPv6Address
+	for _, endpoint := range settings.Networks {
+		if ipv4 == "" {
+			ipv4 = endpoint.IPAddress
+		}
+		if ipv6 == "" {
+			ipv6 = endpoint.GlobalIPv6Address
+		}
+	}
+	return ipv4, ipv6
+}
+
 // Given an internal port, return the port mapped by docker, if there is one.
-func (c *Container) MappedPort(internal int) (int, bool) {
-	for privatePort, mappedPorts := range c.containerInfo.NetworkSettings.Ports {
-		if privatePort.Int() == internal {
-			for _, port := range mappedPorts {
-				var portInt int
-				_, err := fmt.Sscan(port.HostPort, &portInt)
-				if err != nil {
-					log.Printf("Failed to parse port %q", port.HostPort)
-				} else {
-					return portInt, true
-				}
-			}
+func (c *Container) MappedPort(internal nat.Port) (int, bool) {
+	for _, port := range c.Ports()[internal] {
+		var portInt int
+		_, err := fmt.Sscan(port.HostPort, &portInt)
+		if err != nil {
+			log.Printf("Failed to parse port %q", port.HostPort)
+		} else {
+			return portInt, true
 		}
 	}
 	return -1, false
@@ -300,10 +441,13 @@ func (c *Container) Start() error {
 	}
 
 	// Load container.NetworkSettings
-	c.containerInfo, err = c.client.ContainerInspect(ctx, c.containerID)
+	info, err := c.client.ContainerInspect(ctx, c.containerID)
 	if err != nil {
 		return err
 	}
+	c.infoMu.Lock()
+	c.containerInfo = info
+	c.infoMu.Unlock()
 
 	// Listen on the Closing barrier and send a kill to the container if it
 	// falls.
@@ -347,10 +491,30 @@ func (c *Container) err(err error) {
 	c.Closing.Fall()
 }
 
+// fail records the reason for the container failing and tears it down.
+// Only the first reason is kept.
+func (c *Container) fail(err error) {
+	c.failureMu.Lock()
+	if c.failure == nil {
+		c.failure = err
+	}
+	c.failureMu.Unlock()
+
+	c.Failed.Fall()
+}
+
+// Failure returns the reason the container failed, or nil if it is not known.
+func (c *Container) Failure() error {
+	c.failureMu.Lock()
+	defer c.failureMu.Unlock()
+	return c.failure
+}
+
 // Manage the whole lifecycle of the container in response to a request to
 // start it.
 func (c *Container) Run(imageSource source.ImageSource, payload []byte) (int64, error) {
 
+	defer c.Exited.Fall()
 	defer c.Closing.Fall()
 	defer close(c.errorsW)
 
@@ -359,27 +523,34 @@ func (c *Container) Run(imageSource source.ImageSource, payload []byte) (int64,
 			log.Println("BUG: Async container error:", err)
 			// TODO(pwaller): If this case is hit we might not want to
 			// tear the container down really.
-			c.Failed.Fall()
+			c.fail(err)
 		}
 	}()
 
 	imageName, err := imageSource.Obtain(c.client, payload)
+	if err == nil {
+		c.ImageName = imageName
+		c.ObtainedAt = time.Now()
+		if s, ok := imageSource.(source.EnvSource); ok {
+			c.imageEnv = s.Env(imageName)
+		}
+	}
 	c.Obtained.Fall()
 	if err != nil {
-		c.Failed.Fall()
+		c.fail(fmt.Errorf("obtain: %v", err))
 		return -2, err
 	}
 
 	err = c.Create(imageName)
 	if err != nil {
-		c.Failed.Fall()
+		c.fail(fmt.Errorf("create: %v", err))
 		return -1, err
 	}
 	defer c.Delete()
 
 	err = c.Start()
 	if err != nil {
-		c.Failed.Fall()
+		c.fail(fmt.Errorf("start: %v", err))
 		return -1, err
 	}
 
@@ -401,9 +572,10 @@ func (c *Container) Run(imageSource source.ImageSource, payload []byte) (int64,
 	go func() {
 		if err := c.AwaitListening(); err != nil {
 			log.Printf("AwaitListening failed: %v", err)
-			c.Failed.Fall()
+			c.fail(fmt.Errorf("await listening: %v", err))
 			return
 		}
+		c.ReadyAt = time.Now()
 		c.Ready.Fall()
 	}()
 
@@ -424,6 +596,11 @@ var imageRefRepoPattern = regexp.MustCompile(`^(.*/.*)[:@](.*)$`)
 var imageRefNamePattern = regexp.MustCompile(`^(.*)[:@](.*)$`)
 
 func imageRef(imageName string) (name string, tagDigest string) {
+	// A digest, e.g. repo@sha256:..., contains a colon of its own.
+	if i := strings.LastIndex(imageName, "@"); i >= 0 && !strings.Contains(imageName[i:], "/") {
+		return imageName[:i], imageName[i+1:]
+	}
+
 	if strings.Count(imageName, "/") >= 1 {
 		parts := imageRefRepoPattern.FindAllStringSubmatch(imageName, -1)
 		if len(parts) == 0 {
@@ -1,6 +1,11 @@
 package main
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+)
 
 func TestImageRef(t *testing.T) {
 	data := map[string][]string{
@@ -40,6 +45,12 @@ func TestImageRef(t *testing.T) {
 		"hanoverd": []string{
 			"hanoverd", "latest",
 		},
+		"hanoverd@sha256:0123456789abcdef": []string{
+			"hanoverd", "sha256:0123456789abcdef",
+		},
+		"localhost.localdomain:5000/org/hanoverd@sha256:0123456789abcdef": []string{
+			"localhost.localdomain:5000/org/hanoverd", "sha256:0123456789abcdef",
+		},
 		"": []string{
 			"", "latest",
 		},
@@ -52,3 +63,22 @@ func TestImageRef(t *testing.T) {
 		}
 	}
 }
+
+func TestMakeMappedBindings(t *testing.T) {
+	_, published, err := nat.ParsePortSpecs([]string{"127.0.0.1:80:8000", "53:53/udp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exposed, mapped := makeMappedBindings(published)
+	if len(exposed) != 2 {
+		t.Errorf("Expected both ports to be exposed, got %v", exposed)
+	}
+	want := nat.PortMap{
+		"8000/tcp": {{HostIP: "127.0.0.1"}},
+		"53/udp":   {{}},
+	}
+	if !reflect.DeepEqual(mapped, want) {
+		t.Errorf("Expected %v, got %v", want, mapped)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/sensiblecodeio/barrier"
+)
+
+// fallback runs the --fallback-image whenever there is no healthy primary
+// container, so that something is live. It is replaced as soon as a primary
+// container goes live, in the same way as any other live container.
+type fallback struct {
+	lc    *lifecycle
+	dying *barrier.Barrier
+	// start starts the n'th fallback container. It is nil if there is no
+	// fallback image.
+	start func(n int) *Container
+
+	mu      sync.Mutex
+	latest  int        // generation of the latest primary container
+	current *Container // the fallback container, until it exits
+	n       int
+}
+
+// fallen returns true if `b` has fallen.
+func fallen(b *barrier.Barrier) bool {
+	select {
+	case <-b.Barrier():
+		return true
+	default:
+		return false
+	}
+}
+
+// Started records that primary container `c` has started.
+func (f *fallback) Started(c *Container) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latest = c.Generation
+}
+
+// Failed is called when `c` fails before going live. If it is the latest
+// primary container, the fallback is started, unless a primary is live.
+func (f *fallback) Failed(c *Container) {
+	if c.Fallback {
+		log.Printf("Fallback container %v failed", c.Name)
+		return
+	}
+
+	f.mu.Lock()
+	latest := f.latest
+	f.mu.Unlock()
+	if c.Generation != latest {
+		// A newer container is on its way.
+		return
+	}
+
+	f.ensure(fmt.Sprintf("%v failed", c.Name))
+}
+
+// Flipped is called once `c` is live. A fallback container which is still
+// starting is no longer needed. If `c` is a primary which exits while it is
+// still live, the fallback is started.
+func (f *fallback) Flipped(c *Container) {
+	if c.Fallback || f.start == nil {
+		return
+	}
+
+	f.mu.Lock()
+	if f.current != nil && !fallen(&f.current.Live) {
+		f.current.Superceded.Fall()
+	}
+	f.mu.Unlock()
+
+	go func() {
+		<-c.Exited.Barrier()
+		if f.lc.Live() == c {
+			f.ensure(fmt.Sprintf("live container %v exited", c.Name))
+		}
+	}()
+}
+
+// ensure starts a fallback container, unless there is one already or a
+// healthy primary container is live.
+func (f *fallback) ensure(reason string) {
+	if f.start == nil || fallen(f.dying) {
+		return
+	}
+	if live := f.lc.Live(); live != nil && !live.Fallback && !fallen(&live.Exited) {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.current != nil {
+		return
+	}
+
+	f.n++
+	log.Printf("Starting fallback container, %v", reason)
+	c := f.start(f.n)
+	f.current = c
+
+	go func() {
+		<-c.Exited.Barrier()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.current == c {
+			f.current = nil
+		}
+	}()
+}
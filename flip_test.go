@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/go-connections/nat"
+
+	"github.com/sensiblecodeio/hanoverd/pkg/hooks"
+	"github.com/sensiblecodeio/hanoverd/pkg/redirect"
+)
+
+// fakeContainer returns a container which appears to be running at `ip`,
+// with its internal port 8000 mapped by docker to `mapped`.
+func fakeContainer(wg *sync.WaitGroup, name, ip, mapped string) *Container {
+	c := NewContainer(nil, name, wg)
+	c.containerInfo = types.ContainerJSON{
+		NetworkSettings: &types.NetworkSettings{
+			NetworkSettingsBase: types.NetworkSettingsBase{
+				Ports: nat.PortMap{
+					"8000/tcp": {{HostIP: "0.0.0.0", HostPort: mapped}},
+				},
+			},
+			DefaultNetworkSettings: types.DefaultNetworkSettings{
+				IPAddress: ip,
+			},
+		},
+	}
+	return c
+}
+
+func fakeOptions(t *testing.T, firewall redirect.Backend) Options {
+	_, bindings, err := nat.ParsePortSpecs([]string{"80:8000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Options{portBindings: bindings, firewall: firewall}
+}
+
+func TestFlip(t *testing.T) {
+	var wg sync.WaitGroup
+	fake := &redirect.Fake{}
+
+	c := fakeContainer(&wg, "a", "172.17.0.2", "32768")
+	err := flip(&wg, fakeOptions(t, fake), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []redirect.Redirect{{
+		Protocol:    "tcp",
+		SourcePort:  80,
+		MappedPorts: []int{32768},
+		IPAddress:   "172.17.0.2",
+		TargetPort:  8000,
+		Count:       1,
+	}}
+	if got := fake.Live(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	// Closing the container removes its redirects.
+	c.Closing.Fall()
+	wg.Wait()
+	if got := fake.Configured(); len(got) != 0 {
+		t.Errorf("Expected no redirects after closing, got %v", got)
+	}
+}
+
+func TestFlipWithoutIPv6(t *testing.T) {
+	var wg sync.WaitGroup
+	// The firewall can't redirect IPv6.
+	fake := &redirect.Fake{NoIPv6: true}
+
+	c := fakeContainer(&wg, "a", "172.17.0.2", "32768")
+	c.containerInfo.NetworkSettings.GlobalIPv6Address = "fd00::2"
+	err := flip(&wg, fakeOptions(t, fake), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live := fake.Live()
+	if len(live) != 1 || live[0].IPAddress != "172.17.0.2" || live[0].IPv6Address != "" {
+		t.Errorf("Expected an IPv4 redirect alone, got %v", live)
+	}
+
+	c.Closing.Fall()
+	wg.Wait()
+}
+
+func TestFlipperHandsOver(t *testing.T) {
+	var wg sync.WaitGroup
+	fake := &redirect.Fake{}
+	lc := &lifecycle{hooks: &hooks.Hooks{}, wg: &wg}
+
+	containers := make(chan *Container)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		flipper(&wg, fakeOptions(t, fake), lc, containers)
+	}()
+
+	a := fakeContainer(&wg, "a", "172.17.0.2", "32768")
+	b := fakeContainer(&wg, "b", "172.17.0.3", "32769")
+
+	containers <- a
+	<-a.Live.Barrier()
+	if got := fake.Live()[0].IPAddress; got != "172.17.0.2" {
+		t.Errorf("Expected a to be live, got %v", got)
+	}
+
+	containers <- b
+	<-b.Live.Barrier()
+	if got := fake.Live()[0].IPAddress; got != "172.17.0.3" {
+		t.Errorf("Expected b to be live, got %v", got)
+	}
+	if lc.Live() != b {
+		t.Errorf("Expected lifecycle to have b live")
+	}
+
+	// The old container is closed after the grace period, removing its
+	// redirects and leaving only the new container's.
+	select {
+	case <-a.Closing.Barrier():
+	case <-time.After(time.Second):
+		t.Fatal("Old container wasn't closed")
+	}
+	b.Closing.Fall()
+	close(containers)
+	<-done
+	wg.Wait()
+
+	if got := fake.Configured(); len(got) != 0 {
+		t.Errorf("Expected no redirects after closing, got %v", got)
+	}
+}
+
+func TestFlipperFailure(t *testing.T) {
+	var wg sync.WaitGroup
+	fake := &redirect.Fake{Err: errors.New("firewall broken")}
+	lc := &lifecycle{hooks: &hooks.Hooks{}, wg: &wg}
+
+	containers := make(chan *Container, 1)
+	c := fakeContainer(&wg, "a", "172.17.0.2", "32768")
+	go func() {
+		// flip reports the error on the container's Errors.
+		<-c.Errors
+	}()
+
+	containers <- c
+	close(containers)
+	flipper(&wg, fakeOptions(t, fake), lc, containers)
+
+	select {
+	case <-c.Failed.Barrier():
+	default:
+		t.Error("Expected container to have failed")
+	}
+	select {
+	case <-c.Live.Barrier():
+		t.Error("Expected container not to be live")
+	default:
+	}
+	if lc.Live() != nil {
+		t.Error("Expected nothing to be live")
+	}
+	wg.Wait()
+}
+
+func TestFlipperKeepsPrimaryOverFallback(t *testing.T) {
+	var wg sync.WaitGroup
+	fake := &redirect.Fake{}
+	lc := &lifecycle{hooks: &hooks.Hooks{}, wg: &wg}
+
+	containers := make(chan *Container)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		flipper(&wg, fakeOptions(t, fake), lc, containers)
+	}()
+
+	a := fakeContainer(&wg, "a", "172.17.0.2", "32768")
+	fb := fakeContainer(&wg, "a-fallback-1", "172.17.0.3", "32769")
+	fb.Fallback = true
+
+	containers <- a
+	<-a.Live.Barrier()
+
+	// A healthy primary is live, so the fallback is discarded.
+	containers <- fb
+	<-fb.Closing.Barrier()
+	if lc.Live() != a {
+		t.Errorf("Expected a to remain live")
+	}
+	if got := fake.Live()[0].IPAddress; got != "172.17.0.2" {
+		t.Errorf("Expected a's redirects to be live, got %v", got)
+	}
+
+	a.Closing.Fall()
+	close(containers)
+	<-done
+	wg.Wait()
+}
+
+func TestFlipperVeto(t *testing.T) {
+	var wg sync.WaitGroup
+	fake := &redirect.Fake{}
+	var h hooks.Hooks
+	err := h.Add("going-live=exit 1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := &lifecycle{hooks: &h, wg: &wg}
+
+	containers := make(chan *Container, 1)
+	c := fakeContainer(&wg, "a", "172.17.0.2", "32768")
+	containers <- c
+	close(containers)
+	flipper(&wg, fakeOptions(t, fake), lc, containers)
+
+	select {
+	case <-c.Failed.Barrier():
+	default:
+		t.Error("Expected the vetoed container to have failed")
+	}
+	if lc.Live() != nil || len(fake.Configured()) != 0 {
+		t.Errorf("Expected no flip, got %v", fake.Configured())
+	}
+	wg.Wait()
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	docker "github.com/docker/docker/client"
+	"github.com/sensiblecodeio/barrier"
+
+	"github.com/sensiblecodeio/hanoverd/pkg/hooks"
+	"github.com/sensiblecodeio/hanoverd/pkg/notify"
+)
+
+// lifecycle tracks the live container and runs hooks and sends notifications
+// as containers make lifecycle transitions.
+type lifecycle struct {
+	app      string
+	client   *docker.Client
+	hooks    *hooks.Hooks
+	webhooks []*notify.Webhook
+	status   *notify.Hookbot
+	wg       *sync.WaitGroup
+
+	mu   sync.Mutex
+	live *Container
+}
+
+// Live returns the container currently receiving traffic, or nil.
+func (l *lifecycle) Live() *Container {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.live
+}
+
+func (l *lifecycle) setLive(c *Container) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.live = c
+}
+
+// context describes `c` for the purpose of running hooks.
+func (l *lifecycle) context(event hooks.Event, c *Container) hooks.Context {
+	ipv4, ipv6 := c.IPAddresses()
+	hc := hooks.Context{
+		Event:       event,
+		App:         l.app,
+		Generation:  c.Generation,
+		Image:       c.ImageName,
+		IPAddress:   ipv4,
+		IPv6Address: ipv6,
+		Ports:       map[string]string{},
+	}
+
+	if live := l.Live(); live != nil && live != c {
+		hc.PreviousImage = live.ImageName
+	}
+
+	// Ports are only known once the container has started, which it may not
+	// have for e.g. a failure to obtain the image.
+	for port, bindings := range c.Ports() {
+		if len(bindings) > 0 {
+			hc.Ports[string(port)] = bindings[0].HostPort
+		}
+	}
+
+	return hc
+}
+
+// wants returns true if anything needs to happen on `event`.
+func (l *lifecycle) wants(event hooks.Event) bool {
+	switch event {
+	case hooks.Flipped, hooks.Failed:
+		if len(l.webhooks) > 0 {
+			return true
+		}
+	}
+	if _, ok := statusEvents[event]; ok && l.status != nil {
+		return true
+	}
+	return l.hooks.Has(event)
+}
+
+// Fire runs the hooks for `event` synchronously. A non-nil error is only
+// returned for events which can veto the transition.
+func (l *lifecycle) Fire(event hooks.Event, c *Container) error {
+	if !l.wants(event) {
+		return nil
+	}
+	return l.run(l.context(event, c), c)
+}
+
+func (l *lifecycle) run(hc hooks.Context, c *Container) error {
+	l.publish(statusEvents[hc.Event], c)
+	l.notify(hc, c)
+
+	err := l.hooks.Run(l.client, hc)
+	if err != nil && hc.Event.Vetoes() {
+		return err
+	}
+	return nil
+}
+
+// FireAsync runs the hooks for `event` without blocking. Program exit waits
+// for them to complete.
+func (l *lifecycle) FireAsync(event hooks.Event, c *Container) {
+	if !l.wants(event) {
+		return
+	}
+	// Capture the context now, before the live container changes.
+	hc := l.context(event, c)
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		_ = l.run(hc, c)
+	}()
+}
+
+// statusEvents maps lifecycle events to those published to hookbot.
+var statusEvents = map[hooks.Event]string{
+	hooks.Ready:   notify.Ready,
+	hooks.Flipped: notify.Live,
+	hooks.Failed:  notify.Failed,
+}
+
+// Started publishes that a new generation is starting.
+func (l *lifecycle) Started(c *Container) {
+	if l.status == nil {
+		return
+	}
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		l.publish(notify.Started, c)
+	}()
+}
+
+// publish sends the status of `c` to hookbot.
+func (l *lifecycle) publish(event string, c *Container) {
+	if l.status == nil || event == "" {
+		return
+	}
+
+	host, _ := os.Hostname()
+	s := notify.Status{
+		App:        l.app,
+		Host:       host,
+		Event:      event,
+		Generation: c.Generation,
+		Image:      c.ImageName,
+		SHA:        c.SHA,
+		Time:       time.Now(),
+	}
+	if err := c.Failure(); event == notify.Failed && err != nil {
+		s.Error = err.Error()
+	}
+
+	err := l.status.Publish(s)
+	if err != nil {
+		log.Printf("Publishing %v status to hookbot failed: %v", event, err)
+	}
+}
+
+// Locked publishes a change in whether automatic deploys are locked.
+func (l *lifecycle) Locked(locked bool, reason string) {
+	if l.status == nil {
+		return
+	}
+
+	host, _ := os.Hostname()
+	s := notify.Status{
+		App:    l.app,
+		Host:   host,
+		Event:  notify.Unlocked,
+		Reason: reason,
+		Time:   time.Now(),
+	}
+	if locked {
+		s.Event = notify.Locked
+	}
+
+	err := l.status.Publish(s)
+	if err != nil {
+		log.Printf("Publishing lock status to hookbot failed: %v", err)
+	}
+}
+
+// notify sends the outcome of a deploy to the webhooks.
+func (l *lifecycle) notify(hc hooks.Context, c *Container) {
+	if len(l.webhooks) == 0 {
+		return
+	}
+
+	d := notify.Deploy{
+		App:           hc.App,
+		Generation:    hc.Generation,
+		Image:         hc.Image,
+		PreviousImage: hc.PreviousImage,
+		Time:          time.Now(),
+	}
+
+	switch hc.Event {
+	case hooks.Flipped:
+		d.Outcome = notify.Success
+		d.TotalDuration = c.LiveAt.Sub(c.Started)
+
+	case hooks.Failed:
+		select {
+		case <-c.Live.Barrier():
+			// Failures after going live are not deploy failures.
+			return
+		default:
+		}
+		d.Outcome = notify.Failure
+		d.TotalDuration = d.Time.Sub(c.Started)
+		d.Error = "unknown error"
+		if err := c.Failure(); err != nil {
+			d.Error = err.Error()
+		}
+
+	default:
+		return
+	}
+
+	if !c.ObtainedAt.IsZero() {
+		d.ObtainDuration = c.ObtainedAt.Sub(c.Started)
+	}
+	if !c.ReadyAt.IsZero() {
+		d.StartupDuration = c.ReadyAt.Sub(c.ObtainedAt)
+	}
+
+	for _, w := range l.webhooks {
+		err := w.Send(d)
+		if err != nil {
+			log.Printf("Webhook %v failed: %v", w.URL, err)
+		}
+	}
+}
+
+// Watch handles the transitions of `c` which are signalled by
+// its barriers, until it has exited.
+func (l *lifecycle) Watch(c *Container) {
+	watched := map[hooks.Event]*barrier.Barrier{
+		hooks.Obtained:   &c.Obtained,
+		hooks.Ready:      &c.Ready,
+		hooks.Failed:     &c.Failed,
+		hooks.Superseded: &c.Superceded,
+		hooks.Closed:     &c.Exited,
+	}
+
+	for event, b := range watched {
+		if !l.wants(event) {
+			continue
+		}
+
+		l.wg.Add(1)
+		go func(event hooks.Event, b *barrier.Barrier) {
+			defer l.wg.Done()
+
+			select {
+			case <-b.Barrier():
+			case <-c.Exited.Barrier():
+				// Only fire if the transition happened before exit.
+				select {
+				case <-b.Barrier():
+				default:
+					return
+				}
+			}
+
+			if event == hooks.Obtained && c.ImageName == "" {
+				// Obtained falls even if obtaining the image failed.
+				return
+			}
+
+			log.Printf("Container %v: %v", c.Name, event)
+			_ = l.run(l.context(event, c), c)
+		}(event, b)
+	}
+}
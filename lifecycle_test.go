@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sensiblecodeio/hanoverd/pkg/hooks"
+	"github.com/sensiblecodeio/hanoverd/pkg/notify"
+)
+
+func TestHooksBeforeStart(t *testing.T) {
+	var wg sync.WaitGroup
+	dir := t.TempDir()
+
+	var h hooks.Hooks
+	for _, spec := range []string{
+		"obtained=env > " + filepath.Join(dir, "obtained"),
+		"failed=env > " + filepath.Join(dir, "failed"),
+		"superseded=env > " + filepath.Join(dir, "superseded"),
+	} {
+		err := h.Add(spec, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	lc := &lifecycle{app: "app", hooks: &h, wg: &wg}
+
+	// Neither container is started, so has no network settings.
+	obtained := NewContainer(nil, "app-1", &wg)
+	lc.Watch(obtained)
+	obtained.ImageName = "app:v1"
+	obtained.Obtained.Fall()
+	obtained.Superceded.Fall()
+	obtained.Exited.Fall()
+
+	failed := NewContainer(nil, "app-2", &wg)
+	lc.Watch(failed)
+	failed.Obtained.Fall()
+	failed.fail(errors.New("obtain: no such image"))
+	failed.Exited.Fall()
+
+	wg.Wait()
+
+	for _, event := range []string{"obtained", "failed", "superseded"} {
+		env, err := os.ReadFile(filepath.Join(dir, event))
+		if err != nil {
+			t.Errorf("Expected the %v hook to have run: %v", event, err)
+			continue
+		}
+		if !strings.Contains(string(env), "HANOVERD_EVENT="+event+"\n") {
+			t.Errorf("Expected HANOVERD_EVENT=%v in the %v hook's environment", event, event)
+		}
+		if !strings.Contains(string(env), "HANOVERD_PORTS=\n") {
+			t.Errorf("Expected no ports in the %v hook's environment", event)
+		}
+	}
+}
+
+func TestWebhookObtainFailure(t *testing.T) {
+	var wg sync.WaitGroup
+
+	var got notify.Deploy
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := json.NewDecoder(r.Body).Decode(&got)
+		if err != nil {
+			t.Errorf("Failed to decode body: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	webhook, err := notify.NewWebhook(ts.URL, "json", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := &lifecycle{
+		app:      "app",
+		hooks:    &hooks.Hooks{},
+		webhooks: []*notify.Webhook{webhook},
+		wg:       &wg,
+	}
+
+	// The image couldn't be obtained, so the container never started.
+	c := NewContainer(nil, "app-1", &wg)
+	c.Generation = 1
+	lc.Watch(c)
+	c.Obtained.Fall()
+	c.fail(errors.New("obtain: manifest unknown"))
+	c.Exited.Fall()
+	wg.Wait()
+
+	if got.Outcome != notify.Failure {
+		t.Errorf("Expected outcome %v, got %q", notify.Failure, got.Outcome)
+	}
+	if got.Generation != 1 || got.Error != "obtain: manifest unknown" {
+		t.Errorf("Expected generation 1's obtain error, got %+v", got)
+	}
+}
+
+func TestStatusEvents(t *testing.T) {
+	var wg sync.WaitGroup
+
+	var (
+		mu  sync.Mutex
+		got = map[string]notify.Status{}
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var s notify.Status
+		err := json.NewDecoder(r.Body).Decode(&s)
+		if err != nil {
+			t.Errorf("Failed to decode body: %v", err)
+		}
+		mu.Lock()
+		got[s.App+" "+s.Event] = s
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	lc := func(app string) *lifecycle {
+		return &lifecycle{
+			app:    app,
+			hooks:  &hooks.Hooks{},
+			status: &notify.Hookbot{URL: ts.URL},
+			wg:     &wg,
+		}
+	}
+
+	// A failure to obtain the image, before the container exists.
+	failed := NewContainer(nil, "failed-1", &wg)
+	failed.Generation = 1
+	failedLC := lc("failed")
+	failedLC.Started(failed)
+	failedLC.Watch(failed)
+	failed.fail(errors.New("obtain: manifest unknown"))
+	failed.Obtained.Fall()
+	failed.Exited.Fall()
+
+	// A container which goes live.
+	live := fakeContainer(&wg, "live-1", "172.17.0.2", "32768")
+	live.Generation = 1
+	live.ImageName = "live:v1"
+	liveLC := lc("live")
+	liveLC.Watch(live)
+	live.Ready.Fall()
+	err := liveLC.Fire(hooks.Flipped, live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live.Exited.Fall()
+
+	wg.Wait()
+
+	for _, key := range []string{"failed started", "failed failed", "live ready", "live live"} {
+		s, ok := got[key]
+		if !ok {
+			t.Errorf("Expected %q to be published, got %v", key, got)
+			continue
+		}
+		if s.Generation != 1 {
+			t.Errorf("%v: expected generation 1, got %v", key, s.Generation)
+		}
+	}
+	if s := got["failed failed"]; s.Error != "obtain: manifest unknown" {
+		t.Errorf("Expected the obtain error to be published, got %q", s.Error)
+	}
+	if len(got) != 4 {
+		t.Errorf("Expected 4 statuses, got %v", got)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sensiblecodeio/hanoverd/pkg/freeze"
+)
+
+// deployLock determines whether automatic deploys are allowed. Deploys are
+// locked by a signal, by the presence of a lock file, or during a scheduled
+// freeze window.
+type deployLock struct {
+	file    string
+	windows []freeze.Window
+
+	mu     sync.Mutex
+	manual string // Reason given when locked by a signal.
+
+	changed chan struct{}
+}
+
+func newDeployLock(file string, windows []freeze.Window) *deployLock {
+	return &deployLock{
+		file:    file,
+		windows: windows,
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// Lock locks deploys until Unlock is called.
+func (l *deployLock) Lock(reason string) {
+	l.mu.Lock()
+	l.manual = reason
+	l.mu.Unlock()
+	l.kick()
+}
+
+// Unlock undoes Lock. It has no effect on the lock file or freeze windows.
+func (l *deployLock) Unlock() {
+	l.mu.Lock()
+	l.manual = ""
+	l.mu.Unlock()
+	l.kick()
+}
+
+func (l *deployLock) kick() {
+	select {
+	case l.changed <- struct{}{}:
+	default:
+	}
+}
+
+// State returns whether deploys are locked at `now`, and why.
+func (l *deployLock) State(now time.Time) (bool, string) {
+	l.mu.Lock()
+	manual := l.manual
+	l.mu.Unlock()
+
+	if manual != "" {
+		return true, manual
+	}
+
+	if l.file != "" {
+		content, err := ioutil.ReadFile(l.file)
+		switch {
+		case err == nil:
+			reason := strings.TrimSpace(string(content))
+			if reason == "" {
+				reason = "no reason given"
+			}
+			return true, fmt.Sprintf("lock file %v: %v", l.file, reason)
+		case !os.IsNotExist(err):
+			// Err on the side of caution.
+			return true, fmt.Sprintf("unable to read lock file: %v", err)
+		}
+	}
+
+	for _, w := range l.windows {
+		if w.Active(now) {
+			return true, fmt.Sprintf("freeze window %q", w)
+		}
+	}
+
+	return false, ""
+}
+
+// Monitor re-evaluates the lock each second (and whenever it is changed),
+// telling the queue and lifecycle about changes.
+func (l *deployLock) Monitor(queue *eventQueue, lc *lifecycle) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	locked, reason := false, ""
+	for {
+		nowLocked, nowReason := l.State(time.Now())
+		if nowLocked != locked || nowReason != reason {
+			if nowLocked {
+				log.Printf("Automatic deploys locked: %v", nowReason)
+			} else {
+				log.Printf("Automatic deploys unlocked")
+			}
+			if nowLocked != locked {
+				queue.SetLocked(nowLocked)
+			}
+			lc.Locked(nowLocked, nowReason)
+			locked, reason = nowLocked, nowReason
+		}
+
+		select {
+		case <-ticker.C:
+		case <-l.changed:
+		}
+	}
+}
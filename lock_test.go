@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sensiblecodeio/hanoverd/pkg/freeze"
+	"github.com/sensiblecodeio/hanoverd/pkg/hooks"
+	"github.com/sensiblecodeio/hanoverd/pkg/notify"
+)
+
+func TestDeployLockState(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "lock")
+	window, err := freeze.Parse("0 9 * * 1-5 8h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newDeployLock(file, []freeze.Window{window})
+
+	// 2026-10-17 is a Saturday, 2026-10-19 a Monday.
+	weekend := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	weekday := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	check := func(now time.Time, locked bool, reason string) {
+		t.Helper()
+		gotLocked, gotReason := l.State(now)
+		if gotLocked != locked || !strings.Contains(gotReason, reason) {
+			t.Errorf("Expected (%v, %q), got (%v, %q)", locked, reason, gotLocked, gotReason)
+		}
+	}
+
+	check(weekend, false, "")
+	check(weekday, true, `freeze window "0 9 * * 1-5 8h"`)
+
+	err = os.WriteFile(file, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(weekend, true, "no reason given")
+	err = os.WriteFile(file, []byte("incident 42\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(weekend, true, "lock file "+file+": incident 42")
+
+	// A lock by signal takes precedence, and unlocking it leaves the rest.
+	l.Lock("SIGUSR1")
+	check(weekend, true, "SIGUSR1")
+	l.Unlock()
+	check(weekend, true, "incident 42")
+
+	err = os.Remove(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(weekend, false, "")
+}
+
+func TestDeployLockMonitor(t *testing.T) {
+	statuses := make(chan notify.Status, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var s notify.Status
+		err := json.NewDecoder(r.Body).Decode(&s)
+		if err != nil {
+			t.Errorf("Failed to decode body: %v", err)
+		}
+		statuses <- s
+	}))
+	defer ts.Close()
+
+	var wg sync.WaitGroup
+	lc := &lifecycle{
+		app:    "app",
+		hooks:  &hooks.Hooks{},
+		status: &notify.Hookbot{URL: ts.URL},
+		wg:     &wg,
+	}
+	q := newEventQueue(0)
+	l := newDeployLock("", nil)
+	go l.Monitor(q, lc)
+
+	// The lock is published once the queue has been locked.
+	expectStatus := func(event, reason string) {
+		t.Helper()
+		select {
+		case s := <-statuses:
+			if s.Event != event || s.Reason != reason {
+				t.Errorf("Expected %v (%q), got %v (%q)", event, reason, s.Event, s.Reason)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %v to be published", event)
+		}
+	}
+
+	l.Lock("incident")
+	expectStatus(notify.Locked, "incident")
+
+	// A manual deploy followed by an automatic one is still deployed.
+	manual := &UpdateEvent{Manual: true}
+	automatic := &UpdateEvent{}
+	q.Push(manual)
+	q.Push(automatic)
+	expectEvent(t, q, automatic)
+
+	held := &UpdateEvent{}
+	q.Push(held)
+	expectNoEvent(t, q)
+
+	l.Unlock()
+	expectStatus(notify.Unlocked, "")
+	expectEvent(t, q, held)
+}
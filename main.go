@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -24,8 +25,15 @@ import (
 	"github.com/urfave/cli"
 
 	"github.com/sensiblecodeio/hanoverd/pkg/builder"
+	"github.com/sensiblecodeio/hanoverd/pkg/freeze"
+	"github.com/sensiblecodeio/hanoverd/pkg/hooks"
 	"github.com/sensiblecodeio/hanoverd/pkg/iptables"
+	"github.com/sensiblecodeio/hanoverd/pkg/nftables"
+	"github.com/sensiblecodeio/hanoverd/pkg/notify"
 	"github.com/sensiblecodeio/hanoverd/pkg/opts"
+	"github.com/sensiblecodeio/hanoverd/pkg/proxy"
+	"github.com/sensiblecodeio/hanoverd/pkg/redirect"
+	"github.com/sensiblecodeio/hanoverd/pkg/registryauth"
 	"github.com/sensiblecodeio/hanoverd/pkg/source"
 	"github.com/sensiblecodeio/hanoverd/pkg/util"
 )
@@ -46,13 +54,25 @@ type Options struct {
 	containerArgs        []string
 	ports                nat.PortSet
 	portBindings         nat.PortMap
+	allowedSources       map[nat.Port][]string
 	statusURI            string
+	udpProbe             []byte
 	disableOverlap       bool
 	overlapGraceDuration time.Duration
+	hooks                hooks.Hooks
+	webhooks             []*notify.Webhook
+	hookbotStatus        string
+	debounce             time.Duration
+	lock                 *deployLock
+	firewall             redirect.Backend
+	maintenance          *maintenance
+	fallbackImage        string
+	registryAuth         *registryauth.Store
 }
 
 type UpdateEvent struct {
 	Payload       []byte // input
+	Manual        bool   // Requested by an operator, not subject to locks
 	OutputStream  io.Writer
 	Obtained      barrier.Barrier
 	BuildComplete chan<- struct{}
@@ -93,6 +113,11 @@ func main() {
 			Usage: "ports to publish (same syntax as docker)",
 			Value: &cli.StringSlice{},
 		},
+		cli.StringSliceFlag{
+			Name:  "publish-allow",
+			Usage: "only allow sources to connect to a published port (port[/proto]=cidr[,cidr...])",
+			Value: &cli.StringSlice{},
+		},
 		cli.StringSliceFlag{
 			Name:  "volume, v",
 			Usage: "Bind mount a volume",
@@ -103,21 +128,154 @@ func main() {
 			Usage: "Supply mounts",
 			Value: &cli.StringSlice{},
 		},
+		cli.StringFlag{
+			Name:  "firewall",
+			Usage: "how to redirect traffic: iptables, nftables, proxy, http or auto",
+			Value: "auto",
+		},
+		cli.DurationFlag{
+			Name:  "http-hold",
+			Usage: "with --firewall http, how long to hold or retry requests while no container is live",
+			Value: 30 * time.Second,
+		},
+		cli.BoolFlag{
+			Name:  "firewall-dry-run",
+			Usage: "log the firewall rules which would be applied instead of applying them",
+		},
+		cli.DurationFlag{
+			Name:  "reconcile-interval",
+			Usage: "how often to restore the live container's firewall rules if they have gone missing (0 disables)",
+			Value: 30 * time.Second,
+		},
+		cli.StringFlag{
+			Name:  "fallback-image",
+			Usage: "image to run and make live whenever no container of the app is healthy",
+		},
+		cli.StringFlag{
+			Name:  "maintenance-page",
+			Usage: "HTML file to serve with a 503 on published TCP ports while no container is live",
+		},
+		cli.StringFlag{
+			Name:  "maintenance-html",
+			Usage: "HTML to serve with a 503 on published TCP ports while no container is live",
+		},
+		cli.DurationFlag{
+			Name:  "maintenance-retry-after",
+			Usage: "Retry-After to send with the maintenance page",
+			Value: 30 * time.Second,
+		},
 		cli.StringFlag{
 			Name:  "status-uri",
 			Usage: "specify URI which returns 200 OK when functioning correctly",
 			Value: "/",
 		},
+		cli.StringFlag{
+			Name:  "udp-probe",
+			Usage: "payload (a Go string literal without quotes) to send to UDP ports; any reply means ready",
+		},
+		cli.StringFlag{
+			Name:  "git",
+			Usage: "clone URL or local path of a git repository to build and run",
+		},
+		cli.StringFlag{
+			Name:  "git-ref",
+			Usage: "branch, tag or SHA to check out with --git, unless a hookbot event gives a SHA",
+			Value: "HEAD",
+		},
+		cli.StringFlag{
+			Name:  "git-tags",
+			Usage: "with --git, follow the highest tag matching a semver constraint, e.g. 'v2.*' or '>=1.4 <2'",
+		},
+		cli.StringFlag{
+			Name:  "git-image-root",
+			Usage: "directory within the --git repository to build the image from",
+		},
 		cli.StringFlag{
 			Name:   "hookbot",
 			Usage:  "url of hookbot websocket endpoint to monitor for updates",
 			EnvVar: "HOOKBOT_URL",
 		},
+		cli.StringFlag{
+			Name:   "registry-auth",
+			Usage:  "docker config.json to take registry credentials from (default ~/.docker/config.json)",
+			EnvVar: "HANOVERD_REGISTRY_AUTH",
+		},
+		cli.StringFlag{
+			Name:  "context-url",
+			Usage: "build the image from a build context tarball at an http(s):// or s3://bucket/key URL",
+		},
+		cli.StringFlag{
+			Name:  "tarball",
+			Usage: "load the image from a tarball made by docker save, or from the newest file in a directory",
+		},
+		cli.DurationFlag{
+			Name:  "tarball-poll",
+			Usage: "with a --tarball directory, check this often for a newer file and deploy it (0 disables)",
+			Value: 5 * time.Second,
+		},
+		cli.DurationFlag{
+			Name:  "poll-registry",
+			Usage: "when pulling an image, check the registry this often and deploy when the tag's digest changes (0 disables)",
+		},
+		cli.StringFlag{
+			Name:   "hookbot-status",
+			Usage:  "url of hookbot pub endpoint to publish deploy status to",
+			EnvVar: "HOOKBOT_STATUS_URL",
+		},
+		cli.DurationFlag{
+			Name:  "debounce",
+			Usage: "length of quiet time to wait for before acting on a burst of deploy events",
+		},
+		cli.StringFlag{
+			Name:   "lock-file",
+			Usage:  "automatic deploys are locked while this file exists (its content is the reason)",
+			EnvVar: "HANOVERD_LOCK_FILE",
+		},
+		cli.StringSliceFlag{
+			Name:  "freeze",
+			Usage: "lock automatic deploys during a window (\"min hour dom month dow duration\")",
+			Value: &cli.StringSlice{},
+		},
 		cli.DurationFlag{
 			Name:  "overlap-grace-duration",
 			Usage: "length of time to wait before killing a superceded container",
 			Value: 1 * time.Second,
 		},
+		cli.StringSliceFlag{
+			Name:  "hook",
+			Usage: "run a command on a lifecycle event (event=command)",
+			Value: &cli.StringSlice{},
+		},
+		cli.StringSliceFlag{
+			Name:  "hook-container",
+			Usage: "run a container on a lifecycle event (event=image [args...])",
+			Value: &cli.StringSlice{},
+		},
+		cli.DurationFlag{
+			Name:  "hook-timeout",
+			Usage: "length of time a hook may run before it is considered failed",
+			Value: 5 * time.Minute,
+		},
+		cli.StringSliceFlag{
+			Name:   "notify-url",
+			Usage:  "url to POST the outcome of each deploy to",
+			EnvVar: "HANOVERD_NOTIFY_URL",
+			Value:  &cli.StringSlice{},
+		},
+		cli.StringFlag{
+			Name:  "notify-format",
+			Usage: "body of deploy notifications: json or slack",
+			Value: "json",
+		},
+		cli.StringFlag{
+			Name:  "notify-template",
+			Usage: "text/template for slack deploy notifications",
+		},
+		cli.IntFlag{
+			Name:  "notify-retries",
+			Usage: "number of times to retry a failed deploy notification",
+			Value: 3,
+		},
 	}
 
 	app.Action = ActionRun
@@ -139,6 +297,19 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:      "lock",
+			Usage:     "lock automatic deploys of a running hanoverd",
+			ArgsUsage: "[reason]",
+			Action:    ActionLock,
+			Flags:     lockFileFlags,
+		},
+		{
+			Name:   "unlock",
+			Usage:  "unlock automatic deploys of a running hanoverd",
+			Action: ActionUnlock,
+			Flags:  lockFileFlags,
+		},
 		{
 			Name:   "version",
 			Action: cli.ShowVersion,
@@ -156,8 +327,52 @@ func ActionRun(c *cli.Context) {
 	options.mounts = c.StringSlice("mount")
 	options.env = makeEnv(c.StringSlice("env"))
 	options.statusURI = c.String("status-uri")
+	if c.IsSet("udp-probe") {
+		probe, err := strconv.Unquote(`"` + c.String("udp-probe") + `"`)
+		if err != nil {
+			log.Fatalln("--udp-probe:", err)
+		}
+		options.udpProbe = []byte(probe)
+	}
 	options.disableOverlap = c.Bool("disable-overlap")
+	options.fallbackImage = c.String("fallback-image")
 	options.overlapGraceDuration = c.Duration("overlap-grace-duration")
+	options.debounce = c.Duration("debounce")
+
+	var windows []freeze.Window
+	for _, spec := range c.StringSlice("freeze") {
+		w, err := freeze.Parse(spec)
+		if err != nil {
+			log.Fatalln("--freeze:", err)
+		}
+		windows = append(windows, w)
+	}
+	options.lock = newDeployLock(c.String("lock-file"), windows)
+	options.registryAuth, err = registryauth.Load(c.GlobalString("registry-auth"))
+	if err != nil {
+		log.Fatalln("--registry-auth:", err)
+	}
+	options.hooks.Timeout = c.Duration("hook-timeout")
+	options.hooks.Auth = options.registryAuth
+	for _, spec := range c.StringSlice("hook") {
+		if err := options.hooks.Add(spec, false); err != nil {
+			log.Fatalln("--hook:", err)
+		}
+	}
+	for _, spec := range c.StringSlice("hook-container") {
+		if err := options.hooks.Add(spec, true); err != nil {
+			log.Fatalln("--hook-container:", err)
+		}
+	}
+	options.hookbotStatus = c.String("hookbot-status")
+	for _, u := range c.StringSlice("notify-url") {
+		w, err := notify.NewWebhook(u, c.String("notify-format"), c.String("notify-template"))
+		if err != nil {
+			log.Fatalln("--notify-url:", err)
+		}
+		w.Retries = c.Int("notify-retries")
+		options.webhooks = append(options.webhooks, w)
+	}
 
 	containerName := "hanoverd"
 	var imageSource source.ImageSource
@@ -172,6 +387,42 @@ func ActionRun(c *cli.Context) {
 
 		options.containerArgs = c.Args()
 
+		if c.String("git") != "" {
+			log.Fatalf("--git can't be combined with --hookbot, use a /sub/git/ hookbot URL")
+		}
+
+	} else if c.String("context-url") != "" {
+
+		urlSource, err := source.NewURLSource(c.String("context-url"))
+		if err != nil {
+			log.Fatalf("Failed to parse --context-url: %v", err)
+		}
+		containerName, imageSource = urlSource.Name(), urlSource
+
+		options.containerArgs = c.Args()
+
+	} else if c.String("tarball") != "" {
+
+		tarballSource := &source.TarballSource{Path: c.String("tarball")}
+		containerName, imageSource = tarballSource.Name(), tarballSource
+
+		options.containerArgs = c.Args()
+
+	} else if c.String("git") != "" {
+
+		var gitSource *source.GitSource
+		if c.String("git-tags") != "" {
+			gitSource, err = source.NewGitTagSource(c.String("git"), c.String("git-tags"), c.String("git-image-root"))
+		} else {
+			gitSource, err = source.NewGitSource(c.String("git"), c.String("git-ref"), c.String("git-image-root"))
+		}
+		if err != nil {
+			log.Fatalf("Failed to parse git source: %v", err)
+		}
+		containerName, imageSource = gitSource.Name(), gitSource
+
+		options.containerArgs = c.Args()
+
 	} else if len(c.Args()) == 0 {
 		imageSource = &source.CwdSource{}
 
@@ -193,14 +444,76 @@ func ActionRun(c *cli.Context) {
 		log.Fatalf("No image source specified")
 	}
 
-	if err := iptables.CheckIPTables(); err != nil {
-		log.Fatal("Unable to run `iptables -L`, see README (", err, ")")
+	if pullSource, ok := imageSource.(*source.DockerPullSource); ok {
+		pullSource.Auth = options.registryAuth
+	}
+
+	// What to poll for changes which should be deployed, if anything.
+	var (
+		pollWhat     string
+		pollCurrent  func() (string, error)
+		pollInterval time.Duration
+	)
+	if interval := c.Duration("poll-registry"); interval > 0 {
+		pullSource, ok := imageSource.(*source.DockerPullSource)
+		if !ok {
+			log.Fatalln("--poll-registry needs an image to pull")
+		}
+		client, err := util.DockerClient()
+		if err != nil {
+			log.Fatalln("Connecting to Docker failed:", err)
+		}
+		pollWhat, pollInterval = "registry", interval
+		pollCurrent = func() (string, error) { return pullSource.Digest(client) }
+	}
+	if tarballSource, ok := imageSource.(*source.TarballSource); ok {
+		info, err := os.Stat(tarballSource.Path)
+		if err != nil {
+			log.Fatalln("--tarball:", err)
+		}
+		if interval := c.Duration("tarball-poll"); info.IsDir() && interval > 0 {
+			pollWhat, pollInterval = tarballSource.Path, interval
+			pollCurrent = tarballSource.Latest
+		}
+	}
+
+	options.firewall, err = newFirewall(c.String("firewall"), c.Duration("http-hold"))
+	if err != nil {
+		log.Fatalln("--firewall:", err)
+	}
+	if c.Bool("firewall-dry-run") {
+		describer, ok := options.firewall.(redirect.Describer)
+		if !ok {
+			log.Fatalf("--firewall-dry-run: %v can't describe its rules", options.firewall.Name())
+		}
+		options.firewall = redirect.DryRun{Backend: describer}
+	}
+	if err := options.firewall.Check(); err != nil {
+		log.Fatal("Unable to use ", options.firewall.Name(), ", see README (", err, ")")
+	}
+	log.Printf("Redirecting traffic with %v", options.firewall.Name())
+
+	if r, ok := options.firewall.(redirect.Reconciler); ok && c.Duration("reconcile-interval") > 0 {
+		go reconcile(r, c.Duration("reconcile-interval"))
 	}
 
 	options.ports, options.portBindings, err = nat.ParsePortSpecs(c.StringSlice("publish"))
 	if err != nil {
 		log.Fatalln("--publish:", err)
 	}
+	options.allowedSources, err = parseAllowedSources(
+		c.StringSlice("publish-allow"), options.portBindings)
+	if err != nil {
+		log.Fatalln("--publish-allow:", err)
+	}
+
+	if c.IsSet("maintenance-page") || c.IsSet("maintenance-html") {
+		options.maintenance = &maintenance{
+			File:       c.String("maintenance-page"),
+			HTML:       c.String("maintenance-html"),
+			RetryAfter: c.Duration("maintenance-retry-after"),
+		}
+	}
 
 	log.Println("Hanoverd")
 
@@ -211,6 +524,13 @@ func ActionRun(c *cli.Context) {
 	var dying barrier.Barrier
 	defer dying.Fall()
 
+	if options.maintenance != nil {
+		err := options.maintenance.Start(&wg, &dying, options)
+		if err != nil {
+			log.Fatalln("Unable to serve maintenance page:", err)
+		}
+	}
+
 	if IsStdinReadable() {
 		log.Println("Press CTRL-D to exit")
 		go func() {
@@ -222,18 +542,32 @@ func ActionRun(c *cli.Context) {
 		}()
 	}
 
-	events := make(chan *UpdateEvent, 1)
-	originalEvent := &UpdateEvent{}
-	events <- originalEvent
+	events := newEventQueue(options.debounce)
+	originalEvent := &UpdateEvent{Manual: true}
+	events.Push(originalEvent)
 
 	// SIGHUP handler
 	go func() {
-		sig := make(chan os.Signal)
+		sig := make(chan os.Signal, 1)
 		signal.Notify(sig, unix.SIGHUP)
 		for value := range sig {
 			log.Printf("Received signal %s", value)
 			// Resend the original event
-			events <- originalEvent
+			events.Push(originalEvent)
+		}
+	}()
+
+	// SIGUSR1 locks automatic deploys, SIGUSR2 unlocks them.
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, unix.SIGUSR1, unix.SIGUSR2)
+		for value := range sig {
+			log.Printf("Received signal %s", value)
+			if value == unix.SIGUSR1 {
+				options.lock.Lock(fmt.Sprintf("%v at %v", value, time.Now().Format(time.RFC3339)))
+			} else {
+				options.lock.Unlock()
+			}
 		}
 	}()
 
@@ -245,7 +579,7 @@ func ActionRun(c *cli.Context) {
 
 		defer log.Printf("Received signal %v", value)
 
-		sig := make(chan os.Signal)
+		sig := make(chan os.Signal, 1)
 		signal.Notify(sig, unix.SIGTERM, unix.SIGINT)
 		value = <-sig
 	}()
@@ -254,12 +588,57 @@ func ActionRun(c *cli.Context) {
 		go MonitorHookbot(c.GlobalString("hookbot"), events)
 	}
 
+	if pollCurrent != nil {
+		go poll(pollWhat, pollCurrent, pollInterval, events, &dying)
+	}
+
 	go loop(containerName, imageSource, &wg, &dying, options, events)
 
 	<-dying.Barrier()
 }
 
-func MonitorHookbot(target string, notify chan<- *UpdateEvent) {
+var lockFileFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "lock-file",
+		Usage:  "lock file watched by the running hanoverd",
+		EnvVar: "HANOVERD_LOCK_FILE",
+	},
+}
+
+// ActionLock locks automatic deploys by writing the reason to the lock file.
+func ActionLock(c *cli.Context) {
+	lockFile := c.String("lock-file")
+	if lockFile == "" {
+		log.Fatalln("--lock-file must be specified")
+	}
+
+	reason := strings.Join(c.Args(), " ")
+	if reason == "" {
+		reason = "locked by " + os.Getenv("USER")
+	}
+
+	err := ioutil.WriteFile(lockFile, []byte(reason+"\n"), 0644)
+	if err != nil {
+		log.Fatalf("Failed to write lock file: %v", err)
+	}
+	log.Printf("Automatic deploys locked: %v", reason)
+}
+
+// ActionUnlock unlocks automatic deploys by removing the lock file.
+func ActionUnlock(c *cli.Context) {
+	lockFile := c.String("lock-file")
+	if lockFile == "" {
+		log.Fatalln("--lock-file must be specified")
+	}
+
+	err := os.Remove(lockFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Failed to remove lock file: %v", err)
+	}
+	log.Printf("Automatic deploys unlocked")
+}
+
+func MonitorHookbot(target string, queue *eventQueue) {
 	finish := make(chan struct{})
 	header := http.Header{}
 	events, errs := listen.RetryingWatch(target, header, finish)
@@ -291,12 +670,9 @@ func MonitorHookbot(target string, notify chan<- *UpdateEvent) {
 		// outBound.Source.githubURL = "github.com/sensiblecodeio/hookbot"
 		// outBound.Source.githubRef = data["SHA"]
 
-		notify <- outBound
-
-		<-outBound.Obtained.Barrier()
-
-		// <-done
-		log.Printf("--- Build completed %v ---", "TODO(pwaller): Determine name from payload")
+		// Don't block on the build, so that a burst of events is coalesced
+		// by the queue rather than backing up behind each build.
+		queue.Push(outBound)
 	}
 }
 
@@ -320,7 +696,7 @@ func loop(
 	wg *sync.WaitGroup,
 	dying *barrier.Barrier,
 	options Options,
-	events <-chan *UpdateEvent,
+	events *eventQueue,
 ) {
 	client, err := util.DockerClient()
 	if err != nil {
@@ -329,42 +705,50 @@ func loop(
 		return
 	}
 
-	flips := make(chan *Container)
-	go flipper(wg, options, flips)
-
-	var i int
-	supercede := func() {}
+	lc := &lifecycle{
+		app:      containerName,
+		client:   client,
+		hooks:    &options.hooks,
+		webhooks: options.webhooks,
+		wg:       wg,
+	}
+	if options.hookbotStatus != "" {
+		lc.status = &notify.Hookbot{URL: options.hookbotStatus}
+	}
 
-	for event := range events {
+	go options.lock.Monitor(events, lc)
 
-		name := fmt.Sprint(containerName, "-", i)
-		i++
-
-		log.Printf("New container starting: %q", name)
-		if options.disableOverlap {
-			log.Printf("Overlap switched off, killing old")
-			flips <- nil
-		}
+	flips := make(chan *Container)
+	go flipper(wg, options, lc, flips)
 
+	// newContainer makes a container for the app, which isn't started yet.
+	newContainer := func(name string, generation int) *Container {
 		c := NewContainer(client, name, wg)
+		c.Generation = generation
 		c.Args = options.containerArgs
 		c.Env = options.env
 		c.Volumes = options.volumes
+		c.PortBindings = options.portBindings
 		var mountOpts opts.MountOpt
 		for _, mount := range options.mounts {
 			mountOpts.Set(mount) // note: set is really 'append'.
 		}
 		c.Mounts = mountOpts.Value()
 		c.StatusURI = options.statusURI
-
-		c.Obtained.Forward(&event.Obtained)
+		c.UDPProbe = options.udpProbe
 
 		// Global exit should cause container exit
 		dying.Forward(&c.Closing)
+		return c
+	}
 
-		// Cancel an existing startup, if there is one.
-		supercede()
-		supercede = c.Superceded.Fall
+	fallback := &fallback{lc: lc, dying: dying}
+
+	// launch runs `c` with an image from `imageSource`, and flips to it when
+	// it's ready.
+	launch := func(c *Container, imageSource source.ImageSource, payload []byte) {
+		lc.Started(c)
+		lc.Watch(c)
 
 		wg.Add(1)
 		go func(c *Container) {
@@ -372,11 +756,12 @@ func loop(
 
 			if imageSource == nil {
 				log.Printf("No image source specified")
-				c.Failed.Fall()
+				c.fail(fmt.Errorf("no image source specified"))
+				c.Exited.Fall()
 				return
 			}
 
-			status, err := c.Run(imageSource, event.Payload)
+			status, err := c.Run(imageSource, payload)
 			if err != nil {
 				log.Println("Container run failed:", strings.TrimSpace(err.Error()))
 				return
@@ -393,6 +778,7 @@ func loop(
 			case <-c.Failed.Barrier():
 				log.Println("Container failed before going live:", c.Name)
 				c.Closing.Fall()
+				fallback.Failed(c)
 				return
 			case <-c.Superceded.Barrier():
 				log.Println("Container superceded before going live:", c.Name)
@@ -407,15 +793,90 @@ func loop(
 
 			log.Println("Container going live:", c.Name)
 
+			// Don't let a newer event supersede this one mid-flip.
+			events.Hold()
+			defer events.Release()
+
 			flips <- c
+
+			select {
+			case <-c.Live.Barrier():
+				fallback.Flipped(c)
+			case <-c.Failed.Barrier():
+			case <-c.Closing.Barrier():
+				// A fallback which wasn't needed after all.
+			}
 		}(c)
 	}
+
+	if options.fallbackImage != "" {
+		fallbackSource := source.DockerPullSourceFromImage(options.fallbackImage)
+		fallbackSource.Auth = options.registryAuth
+		fallback.start = func(n int) *Container {
+			c := newContainer(fmt.Sprint(containerName, "-fallback-", n), -1)
+			c.Fallback = true
+			launch(c, fallbackSource, nil)
+			return c
+		}
+	}
+
+	var i int
+	supercede := func() {}
+
+	for event := range events.Events() {
+
+		generation := i
+		name := fmt.Sprint(containerName, "-", generation)
+		i++
+
+		log.Printf("New container starting: %q", name)
+		if options.disableOverlap {
+			log.Printf("Overlap switched off, killing old")
+			flips <- nil
+		}
+
+		c := newContainer(name, generation)
+		c.SHA = source.PayloadSHA(event.Payload)
+		c.Obtained.Forward(&event.Obtained)
+
+		// Cancel an existing startup, if there is one.
+		supercede()
+		supercede = c.Superceded.Fall
+
+		fallback.Started(c)
+		launch(c, imageSource, event.Payload)
+	}
+}
+
+// newFirewall returns the backend called `name`. "auto" chooses nftables if
+// iptables is missing or is itself the nf_tables variant, and nft works.
+// `hold` is how long the http backend holds requests for.
+func newFirewall(name string, hold time.Duration) (redirect.Backend, error) {
+	switch name {
+	case "iptables":
+		return iptables.Backend{}, nil
+	case "nftables":
+		return nftables.Backend{}, nil
+	case "proxy":
+		return proxy.New(), nil
+	case "http":
+		return proxy.NewHTTP(hold), nil
+	case "auto":
+		if (iptables.Backend{}).Check() != nil || iptables.IsNFTables() {
+			if nftables.Available() {
+				return nftables.Backend{}, nil
+			}
+		}
+		return iptables.Backend{}, nil
+	}
+	return nil, fmt.Errorf("unknown firewall %q (should be iptables, nftables, proxy, http or auto)", name)
 }
 
 // Manage firewall flips
 func flipper(
 	wg *sync.WaitGroup,
 	options Options,
+	lc *lifecycle,
 	newContainers <-chan *Container,
 ) {
 	var live *Container
@@ -428,16 +889,35 @@ func flipper(
 				live.Closing.Fall()
 			}
 			live = nil
+			lc.setLive(nil)
 			continue
 		}
 
-		err := flip(wg, options, container)
+		if container.Fallback && live != nil && !live.Fallback && !fallen(&live.Exited) {
+			log.Printf("Not flipping to fallback %v, %v is live", container.Name, live.Name)
+			container.Closing.Fall()
+			continue
+		}
+
+		err := lc.Fire(hooks.GoingLive, container)
 		if err != nil {
-			container.Failed.Fall()
+			log.Printf("Flip of %v vetoed: %v", container.Name, err)
+			container.fail(err)
+			continue
+		}
+
+		err = flip(wg, options, container)
+		if err != nil {
+			container.fail(err)
 			// Don't flip the firewall rules if there was a problem.
 			continue
 		}
 
+		container.LiveAt = time.Now()
+		container.Live.Fall()
+
+		lc.FireAsync(hooks.Flipped, container)
+
 		if live != nil {
 			go func(live *Container) {
 				time.Sleep(options.overlapGraceDuration)
@@ -446,6 +926,7 @@ func flipper(
 		}
 
 		live = container
+		lc.setLive(container)
 	}
 }
 
@@ -471,35 +952,93 @@ func flip(wg *sync.WaitGroup, options Options, container *Container) error {
 		}()
 	}()
 
-	for internalPort, bindings := range options.portBindings {
-		if mappedPort, ok := container.MappedPort(internalPort.Int()); ok {
-			for _, binding := range bindings {
-				var public int
-				_, err := fmt.Sscan(binding.HostPort, &public)
-				if err != nil {
-					// If no public port specified, use same port as internal port
-					public = internalPort.Int()
-				}
-
-				ipAddress := container.containerInfo.NetworkSettings.IPAddress
-				remove, err := iptables.ConfigureRedirect(public, mappedPort, ipAddress, internalPort.Int())
-				if err != nil {
-					// Firewall rule didn't get applied.
-					err := fmt.Errorf(
-						"flip: ConfigureRedirect (public: %v, private: %v) failed: %q",
-						public, internalPort, err)
-					container.err(err)
-					return err
-				}
-
-				removal = append(removal, remove)
+	ipAddress, ipv6Address := container.IPAddresses()
+
+	var redirects []redirect.Redirect
+	for _, ports := range portRanges(options.portBindings, options.allowedSources) {
+		var mappedPorts []int
+		for i := 0; i < ports.Count; i++ {
+			internalPort, _ := nat.NewPort(ports.Proto, fmt.Sprint(ports.Internal+i))
+			mappedPort, ok := container.MappedPort(internalPort)
+			if !ok {
+				err := fmt.Errorf("Docker image not exposing port %v!", internalPort)
+				container.err(err)
+				return err
 			}
-		} else {
-			err := fmt.Errorf("Docker image not exposing port %v!", internalPort)
+			mappedPorts = append(mappedPorts, mappedPort)
+		}
+
+		r := redirect.Redirect{
+			Protocol:    ports.Proto,
+			HostIP:      ports.HostIP,
+			SourcePort:  ports.Public,
+			MappedPorts: mappedPorts,
+			IPAddress:   ipAddress,
+			IPv6Address: ipv6Address,
+			TargetPort:  ports.Internal,
+			Count:       ports.Count,
+
+			AllowedSources: ports.Allowed,
+		}
+		if len(r.Destinations()) == 0 {
+			err := fmt.Errorf("flip: container has no address to forward %v to", ports)
 			container.err(err)
 			return err
 		}
+		redirects = append(redirects, r)
+	}
+
+	if len(redirects) == 0 {
+		return nil
+	}
+
+	// All ports are flipped in one go, so that a failure can't leave some
+	// of them pointing at the old container and some at the new one.
+	remove, err := configureRedirects(options.firewall, redirects, "flip")
+	if err != nil {
+		// Firewall rules didn't get applied.
+		err := fmt.Errorf("flip: ConfigureRedirects failed: %q", err)
+		container.err(err)
+		return err
 	}
 
+	removal = append(removal, remove)
+
 	return nil
 }
+
+// configureRedirects configures `redirects` with `firewall`. If that fails
+// and they include IPv6 destinations, for example because ip6tables has no nat
+// table, IPv6 is skipped with a warning and IPv4 is redirected alone.
+func configureRedirects(
+	firewall redirect.Backend,
+	redirects []redirect.Redirect,
+	what string,
+) (func() error, error) {
+	remove, err := firewall.ConfigureRedirects(redirects)
+	if err == nil {
+		return remove, nil
+	}
+
+	var (
+		ipv4 []redirect.Redirect
+		ipv6 bool
+	)
+	for _, r := range redirects {
+		if r.IPv6Address != "" {
+			ipv6 = true
+			r.IPv6Address = ""
+			if len(r.Destinations()) == 0 {
+				// Nothing is left to redirect to.
+				return nil, err
+			}
+		}
+		ipv4 = append(ipv4, r)
+	}
+	if !ipv6 {
+		return nil, err
+	}
+
+	log.Printf("%v: not redirecting to IPv6: %v", what, err)
+	return firewall.ConfigureRedirects(ipv4)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sensiblecodeio/barrier"
+
+	"github.com/sensiblecodeio/hanoverd/pkg/redirect"
+)
+
+// maintenance serves a 503 page on the published TCP ports while there is no
+// live container.
+//
+// Its redirects are configured before any container's, and each container's
+// take precedence over those configured before them, so traffic only reaches
+// the maintenance page when no container's redirects are in place. Nothing
+// needs to change when a container goes live.
+type maintenance struct {
+	// Either File is read for each request, or HTML is served.
+	File       string
+	HTML       string
+	RetryAfter time.Duration
+}
+
+func (m *maintenance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	page := []byte(m.HTML)
+	if m.File != "" {
+		var err error
+		page, err = ioutil.ReadFile(m.File)
+		if err != nil {
+			log.Printf("Maintenance page: %v", err)
+			page = nil
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if m.RetryAfter > 0 {
+		w.Header().Set("Retry-After", fmt.Sprint(int(m.RetryAfter.Seconds())))
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = w.Write(page)
+}
+
+// Start serves the maintenance page and redirects the published TCP ports to
+// it until `dying` falls.
+//
+// The page listens on all addresses, since for remote traffic the firewall
+// redirects to the address of the interface it arrived on. It is served over
+// IPv6 too if IPv6 is usable, and the firewall can redirect it.
+func (m *maintenance) Start(wg *sync.WaitGroup, dying *barrier.Barrier, options Options) error {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return err
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	ipv6Address := "::1"
+	if probe, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		log.Printf("Maintenance page: not serving over IPv6: %v", err)
+		ipv6Address = ""
+	} else {
+		probe.Close()
+	}
+
+	var redirects []redirect.Redirect
+	for _, ports := range portRanges(options.portBindings, options.allowedSources) {
+		if ports.Proto != "tcp" {
+			continue
+		}
+		var mappedPorts []int
+		for i := 0; i < ports.Count; i++ {
+			mappedPorts = append(mappedPorts, port)
+		}
+		redirects = append(redirects, redirect.Redirect{
+			Protocol:       ports.Proto,
+			HostIP:         ports.HostIP,
+			SourcePort:     ports.Public,
+			MappedPorts:    mappedPorts,
+			IPAddress:      "127.0.0.1",
+			IPv6Address:    ipv6Address,
+			TargetPort:     port,
+			Count:          ports.Count,
+			AllowedSources: ports.Allowed,
+			ToHost:         true,
+		})
+	}
+	if len(redirects) == 0 {
+		ln.Close()
+		return fmt.Errorf("no TCP ports are published")
+	}
+
+	remove, err := configureRedirects(options.firewall, redirects, "Maintenance page")
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	go func() {
+		err := http.Serve(ln, m)
+		log.Printf("Maintenance page: %v", err)
+	}()
+	log.Printf("Serving maintenance page on port %d while nothing is live", port)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-dying.Barrier()
+		err := remove()
+		if err != nil {
+			log.Printf("Maintenance page: removal failed: %v", err)
+		}
+	}()
+	return nil
+}
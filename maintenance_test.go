@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/sensiblecodeio/barrier"
+
+	"github.com/sensiblecodeio/hanoverd/pkg/redirect"
+)
+
+func TestMaintenance(t *testing.T) {
+	_, bindings, err := nat.ParsePortSpecs([]string{"80:8000", "53:53/udp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &redirect.Fake{}
+	options := Options{portBindings: bindings, firewall: fake}
+
+	m := &maintenance{HTML: "<h1>Back soon</h1>", RetryAfter: time.Minute}
+
+	var (
+		wg    sync.WaitGroup
+		dying barrier.Barrier
+	)
+	err = m.Start(&wg, &dying, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live := fake.Live()
+	if len(live) != 1 || !live[0].ToHost || live[0].SourcePort != 80 {
+		t.Fatalf("Expected one redirect of port 80 to the host, got %v", live)
+	}
+
+	// Remote traffic is redirected to the address of the interface it
+	// arrived on, so the page must be reachable there as well as locally.
+	for _, ip := range append([]string{"127.0.0.1"}, interfaceAddresses(t)...) {
+		url := fmt.Sprintf("http://%s/", net.JoinHostPort(ip, fmt.Sprint(live[0].TargetPort)))
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Errorf("Expected the page to be reachable on %v: %v", ip, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Expected 503 from the maintenance server on %v, got %v", ip, resp.StatusCode)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, got %v", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Expected Retry-After: 60, got %q", got)
+	}
+	if got := w.Body.String(); got != "<h1>Back soon</h1>" {
+		t.Errorf("Unexpected page %q", got)
+	}
+
+	dying.Fall()
+	wg.Wait()
+	if got := fake.Configured(); len(got) != 0 {
+		t.Errorf("Expected no redirects after exit, got %v", got)
+	}
+}
+
+func TestMaintenanceWithoutIPv6(t *testing.T) {
+	_, bindings, err := nat.ParsePortSpecs([]string{"80:8000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The firewall can't redirect IPv6.
+	fake := &redirect.Fake{NoIPv6: true}
+	options := Options{portBindings: bindings, firewall: fake}
+
+	var (
+		wg    sync.WaitGroup
+		dying barrier.Barrier
+	)
+	err = (&maintenance{HTML: "down"}).Start(&wg, &dying, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live := fake.Live()
+	if len(live) != 1 || live[0].IPAddress == "" || live[0].IPv6Address != "" {
+		t.Errorf("Expected an IPv4 redirect alone, got %v", live)
+	}
+
+	dying.Fall()
+	wg.Wait()
+}
+
+// interfaceAddresses returns the host's non-loopback IPv4 addresses.
+func interfaceAddresses(t *testing.T) []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ips []string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.To4() == nil {
+			continue
+		}
+		ips = append(ips, ipnet.IP.String())
+	}
+	return ips
+}
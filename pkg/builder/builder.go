@@ -2,7 +2,6 @@ package builder
 
 import (
 	"context"
-	"encoding/base64"
 	"fmt"
 	"log"
 	"net/http"
@@ -16,6 +15,7 @@ import (
 	"github.com/sensiblecodeio/hookbot/pkg/listen"
 	"github.com/urfave/cli"
 
+	"github.com/sensiblecodeio/hanoverd/pkg/registryauth"
 	"github.com/sensiblecodeio/hanoverd/pkg/source"
 	"github.com/sensiblecodeio/hanoverd/pkg/util"
 )
@@ -41,6 +41,14 @@ func Action(c *cli.Context) {
 	registry, imageName := ParseRegistryImage(repository)
 	log.Printf("Registry: %v, image: %v", registry, imageName)
 
+	auth, err := registryauth.Load(c.GlobalString("registry-auth"))
+	if err != nil {
+		log.Fatalf("Unable to load registry credentials: %v", err)
+	}
+	if pullSource, ok := imageSource.(*source.DockerPullSource); ok {
+		pullSource.Auth = auth
+	}
+
 	client, err := util.DockerClient()
 	if err != nil {
 		log.Fatalf("Unable to connect to docker: %v", err)
@@ -76,10 +84,13 @@ func Action(c *cli.Context) {
 			return fmt.Errorf("tagimage: %v", err2)
 		}
 
-		blankAuth := base64.URLEncoding.EncodeToString([]byte("{}"))
+		registryAuth, err2 := auth.Encoded(ref)
+		if err2 != nil {
+			return fmt.Errorf("registry auth: %v", err2)
+		}
 
 		rc, err2 := client.ImagePush(context.TODO(), ref, types.ImagePushOptions{
-			RegistryAuth: blankAuth,
+			RegistryAuth: registryAuth,
 		})
 		if err2 != nil {
 			return fmt.Errorf("pushimage: %v", err2)
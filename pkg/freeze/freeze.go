@@ -0,0 +1,180 @@
+// Package freeze implements scheduled windows during which automatic deploys
+// are not allowed.
+package freeze
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Window is a recurring period of time. It starts at each time matched by a
+// cron expression and lasts for Duration.
+type Window struct {
+	Spec     string
+	Duration time.Duration
+
+	minute, hour, dom, month, dow field
+	// Cron matches either day field if both are restricted.
+	domRestricted, dowRestricted bool
+}
+
+// A field is the set of values which match.
+type field map[int]bool
+
+// Parse parses a window of the form "min hour dom month dow duration",
+// e.g, "0 9 * * 1-5 8h" is 9am-5pm on weekdays. The first five fields have
+// the same syntax as crontab(5) (lists, ranges and steps), without names.
+func Parse(s string) (Window, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 6 {
+		return Window{}, fmt.Errorf("freeze window %q: expected 5 cron fields and a duration", s)
+	}
+
+	w := Window{Spec: s}
+
+	var err error
+	w.Duration, err = time.ParseDuration(fields[5])
+	if err != nil {
+		return Window{}, fmt.Errorf("freeze window %q: %v", s, err)
+	}
+	if w.Duration <= 0 {
+		return Window{}, fmt.Errorf("freeze window %q: duration must be positive", s)
+	}
+
+	parsers := []struct {
+		f        *field
+		min, max int
+	}{
+		{&w.minute, 0, 59},
+		{&w.hour, 0, 23},
+		{&w.dom, 1, 31},
+		{&w.month, 1, 12},
+		{&w.dow, 0, 7},
+	}
+	for i, p := range parsers {
+		*p.f, err = parseField(fields[i], p.min, p.max)
+		if err != nil {
+			return Window{}, fmt.Errorf("freeze window %q: %v", s, err)
+		}
+	}
+
+	// Both 0 and 7 are Sunday.
+	if w.dow[7] {
+		w.dow[0] = true
+	}
+	w.domRestricted = fields[2] != "*"
+	w.dowRestricted = fields[4] != "*"
+
+	return w, nil
+}
+
+func parseField(s string, min, max int) (field, error) {
+	f := field{}
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("bad step in %q", part)
+			}
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			lo, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, fmt.Errorf("bad range %q", part)
+				}
+			} else if step != 1 {
+				// "a/n" means "a-max/n".
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			f[v] = true
+		}
+	}
+	return f, nil
+}
+
+// days returns true if the window starts on the day containing `t`.
+func (w Window) days(t time.Time) bool {
+	dom, dow := w.dom[t.Day()], w.dow[int(t.Weekday())]
+	if w.domRestricted && w.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// below returns the greatest value in `f` which is less than `v`.
+func (f field) below(v int) (int, bool) {
+	for v--; v >= 0; v-- {
+		if f[v] {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// Active returns true if `t` falls within the window, i.e. the window
+// started less than Duration before `t`.
+func (w Window) Active(t time.Time) bool {
+	// Each step goes back to the latest minute which could be a start,
+	// skipping whole months, days and hours which can't.
+	since := t.Add(-w.Duration)
+	loc := t.Location()
+	s := t.Truncate(time.Minute)
+	for s.After(since) {
+		y, m, d := s.Date()
+		var prev time.Time
+		switch {
+		case !w.month[int(m)]:
+			prev = time.Date(y, m, 1, 0, 0, 0, 0, loc).Add(-time.Minute)
+
+		case !w.days(s):
+			prev = time.Date(y, m, d, 0, 0, 0, 0, loc).Add(-time.Minute)
+
+		case !w.hour[s.Hour()]:
+			if h, ok := w.hour.below(s.Hour()); ok {
+				prev = time.Date(y, m, d, h, 59, 0, 0, loc)
+			} else {
+				prev = time.Date(y, m, d, 0, 0, 0, 0, loc).Add(-time.Minute)
+			}
+
+		case !w.minute[s.Minute()]:
+			if min, ok := w.minute.below(s.Minute()); ok {
+				prev = s.Add(-time.Duration(s.Minute()-min) * time.Minute)
+			} else {
+				prev = s.Add(-time.Duration(s.Minute()+1) * time.Minute)
+			}
+
+		default:
+			return true
+		}
+
+		if !prev.Before(s) {
+			// Only possible around a change of UTC offset.
+			prev = s.Add(-time.Minute)
+		}
+		s = prev
+	}
+	return false
+}
+
+func (w Window) String() string { return w.Spec }
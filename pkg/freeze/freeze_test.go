@@ -0,0 +1,110 @@
+package freeze
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestWindowActive(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	data := []struct {
+		spec, time string
+		active     bool
+	}{
+		// 2026-10-19 is a Monday.
+		{"0 9 * * 1-5 8h", "2026-10-19 08:59", false},
+		{"0 9 * * 1-5 8h", "2026-10-19 09:00", true},
+		{"0 9 * * 1-5 8h", "2026-10-19 16:59", true},
+		{"0 9 * * 1-5 8h", "2026-10-19 17:00", false},
+		{"0 9 * * 1-5 8h", "2026-10-18 12:00", false},
+		// Windows carry on past midnight.
+		{"30 22 * * 5 4h", "2026-10-24 02:29", true},
+		{"30 22 * * 5 4h", "2026-10-24 02:30", false},
+		// Day of month or day of week, as in cron.
+		{"0 0 1 * 0 24h", "2026-11-01 12:00", true},
+		{"0 0 1 * 0 24h", "2026-10-25 12:00", true},
+		{"0 0 1 * 0 24h", "2026-10-26 12:00", false},
+		{"*/15 * * * * 5m", "2026-10-19 10:35", false},
+		{"*/15 * * * * 5m", "2026-10-19 10:47", true},
+		{"0 0 24-26 12 * 24h", "2026-12-25 18:00", true},
+		// Long windows, and windows starting in a previous year.
+		{"0 0 1 1 * 744h", "2026-01-31 23:59", true},
+		{"0 0 1 1 * 744h", "2026-02-01 00:00", false},
+		{"0 18 31 12 * 48h", "2027-01-02 17:59", true},
+		{"0 18 31 12 * 48h", "2027-01-02 18:00", false},
+		{"45 */6 * 2 * 30m", "2026-02-28 19:14", true},
+		{"45 */6 * 2 * 30m", "2026-02-28 19:15", false},
+		{"45 */6 * 2 * 30m", "2026-03-01 00:50", false},
+	}
+
+	for _, d := range data {
+		w, err := Parse(d.spec)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", d.spec, err)
+			continue
+		}
+		if got := w.Active(at(d.time)); got != d.active {
+			t.Errorf("%q at %v: expected active=%v", d.spec, d.time, d.active)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"0 9 * * 1-5",
+		"0 9 * * 1-5 soon",
+		"60 9 * * * 1h",
+		"0 9 * * 5-1 1h",
+		"*/0 9 * * * 1h",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Expected Parse(%q) to fail", spec)
+		}
+	}
+}
+
+// activeByMinute is Active, checking every minute of the window's duration.
+func activeByMinute(w Window, t time.Time) bool {
+	for s := t.Truncate(time.Minute); t.Sub(s) < w.Duration; s = s.Add(-time.Minute) {
+		if w.minute[s.Minute()] && w.hour[s.Hour()] && w.month[int(s.Month())] && w.days(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWindowActiveByMinute(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, london)
+	for _, spec := range []string{
+		"0 9 * * 1-5 8h",
+		"30 1 * * 0 2h",
+		"*/7 3-5 1,15 * 2 47m",
+		"0 0 29 2 * 36h",
+		"5 4 * 3,10 * 90h",
+	} {
+		w, err := Parse(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2000; i++ {
+			at := start.Add(time.Duration(r.Int63n(int64(2 * 365 * 24 * time.Hour))))
+			if got, want := w.Active(at), activeByMinute(w, at); got != want {
+				t.Errorf("%q at %v: expected active=%v", spec, at, want)
+			}
+		}
+	}
+}
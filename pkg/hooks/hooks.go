@@ -0,0 +1,306 @@
+// Package hooks runs user-defined commands or containers when a container
+// managed by hanoverd makes a lifecycle transition.
+package hooks
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
+
+	"github.com/sensiblecodeio/hanoverd/pkg/registryauth"
+)
+
+// Event is a lifecycle transition which hooks can be attached to.
+type Event string
+
+const (
+	Obtained   Event = "obtained"   // Image has been obtained
+	Ready      Event = "ready"      // Container is accepting requests
+	GoingLive  Event = "going-live" // About to flip traffic, may veto
+	Flipped    Event = "flipped"    // Container is receiving live traffic
+	Failed     Event = "failed"     // Container failed
+	Superseded Event = "superseded" // A newer generation has been started
+	Closed     Event = "closed"     // Container has exited
+)
+
+// Events lists all of the events which hooks can be attached to.
+var Events = []Event{
+	Obtained, Ready, GoingLive, Flipped, Failed, Superseded, Closed,
+}
+
+// Vetoes returns true if a failing hook on this event prevents the
+// transition from happening.
+func (e Event) Vetoes() bool {
+	return e == GoingLive
+}
+
+// ParseEvent returns the Event named `name`.
+func ParseEvent(name string) (Event, error) {
+	for _, e := range Events {
+		if string(e) == name {
+			return e, nil
+		}
+	}
+	return "", fmt.Errorf("unknown hook event %q (valid events: %v)", name, Events)
+}
+
+// Context describes the container undergoing the transition. It is given to
+// hooks as environment variables.
+type Context struct {
+	Event         Event
+	App           string
+	Generation    int
+	Image         string
+	PreviousImage string
+	IPAddress     string
+	IPv6Address   string
+	// Ports maps container ports (e.g, "8000/tcp") to host ports.
+	Ports map[string]string
+}
+
+// Env returns the context as a list of environment variables.
+func (hc Context) Env() []string {
+	env := []string{
+		"HANOVERD_EVENT=" + string(hc.Event),
+		"HANOVERD_APP=" + hc.App,
+		fmt.Sprint("HANOVERD_GENERATION=", hc.Generation),
+		"HANOVERD_IMAGE=" + hc.Image,
+		"HANOVERD_PREVIOUS_IMAGE=" + hc.PreviousImage,
+		"HANOVERD_CONTAINER_IP=" + hc.IPAddress,
+		"HANOVERD_CONTAINER_IPV6=" + hc.IPv6Address,
+	}
+
+	var ports []string
+	for port := range hc.Ports {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+
+	var all []string
+	for _, port := range ports {
+		all = append(all, port+"="+hc.Ports[port])
+		name := strings.ToUpper(strings.Replace(port, "/", "_", 1))
+		env = append(env, "HANOVERD_PORT_"+name+"="+hc.Ports[port])
+	}
+	env = append(env, "HANOVERD_PORTS="+strings.Join(all, " "))
+
+	return env
+}
+
+// Hook is something which is run in response to a lifecycle event.
+type Hook interface {
+	// Run the hook to completion. A non-nil error is returned if the hook
+	// failed to run or did not succeed.
+	Run(ctx context.Context, client *docker.Client, env []string) error
+	String() string
+}
+
+// Command is a Hook which runs `sh -c Command` on the host.
+type Command struct {
+	Command string
+}
+
+func (h *Command) String() string { return fmt.Sprintf("command %q", h.Command) }
+
+func (h *Command) Run(ctx context.Context, _ *docker.Client, env []string) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", h.Command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Container is a Hook which runs a container to completion. The image is
+// pulled the first time the hook runs, if it isn't present.
+type Container struct {
+	Image string
+	Args  []string
+	Auth  *registryauth.Store // credentials to pull Image, if any
+}
+
+func (h *Container) String() string { return fmt.Sprintf("container %q", h.Image) }
+
+func (h *Container) Run(ctx context.Context, c *docker.Client, env []string) error {
+	err := h.pull(ctx, c)
+	if err != nil {
+		return fmt.Errorf("pull %v: %v", h.Image, err)
+	}
+
+	resp, err := c.ContainerCreate(
+		ctx,
+		&container.Config{
+			AttachStdout: true,
+			AttachStderr: true,
+			Env:          env,
+			Cmd:          h.Args,
+			Image:        h.Image,
+			Labels: map[string]string{
+				"orchestrator": "hanoverd",
+				"purpose":      "Lifecycle hook",
+			},
+		},
+		&container.HostConfig{},
+		&network.NetworkingConfig{},
+		nil,
+		"",
+	)
+	if err != nil {
+		return err
+	}
+	containerID := resp.ID
+
+	defer func() {
+		// Use a fresh context, the hook may have timed out.
+		err := c.ContainerRemove(context.Background(), containerID, container.RemoveOptions{
+			RemoveVolumes: true,
+			Force:         true,
+		})
+		if err != nil {
+			log.Printf("Error removing hook container: %v", err)
+		}
+	}()
+
+	attached, err := c.ContainerAttach(ctx, containerID, container.AttachOptions{
+		Stdout: true,
+		Stderr: true,
+		Logs:   true,
+		Stream: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer attached.Close()
+
+	err = c.ContainerStart(ctx, containerID, container.StartOptions{})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		_, _ = stdcopy.StdCopy(os.Stderr, os.Stderr, attached.Reader)
+	}()
+
+	waitBodyC, errC := c.ContainerWait(ctx, containerID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errC:
+		return err
+
+	case waitBody := <-waitBodyC:
+		if waitBody.Error != nil && waitBody.Error.Message != "" {
+			return fmt.Errorf("containerWait: %v", waitBody.Error.Message)
+		}
+		if waitBody.StatusCode != 0 {
+			return fmt.Errorf("non-zero exit status: %v", waitBody.StatusCode)
+		}
+		return nil
+	}
+}
+
+// pull pulls the image unless it is already present.
+func (h *Container) pull(ctx context.Context, c *docker.Client) error {
+	_, _, err := c.ImageInspectWithRaw(ctx, h.Image)
+	if !docker.IsErrNotFound(err) {
+		return err
+	}
+
+	auth, err := h.Auth.Encoded(h.Image)
+	if err != nil {
+		return fmt.Errorf("registry auth: %v", err)
+	}
+
+	log.Printf("Pulling %v for hook", h.Image)
+	rc, err := c.ImagePull(ctx, h.Image, types.ImagePullOptions{
+		RegistryAuth: auth,
+	})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return jsonmessage.DisplayJSONMessagesStream(rc, os.Stderr, 0, false, nil)
+}
+
+// Hooks is a set of hooks to run for each event.
+type Hooks struct {
+	hooks   map[Event][]Hook
+	Timeout time.Duration
+	// Auth is given to container hooks added after it is set, to pull their
+	// images.
+	Auth *registryauth.Store
+}
+
+// Add parses a hook specification of the form `event=command` and adds it.
+// If `inContainer` is true, the command is of the form `image [args...]` and
+// is run in a container, otherwise it is run with `sh -c` on the host.
+func (h *Hooks) Add(spec string, inContainer bool) error {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return fmt.Errorf("hook %q should be of the form event=command", spec)
+	}
+
+	event, err := ParseEvent(parts[0])
+	if err != nil {
+		return err
+	}
+
+	var hook Hook = &Command{parts[1]}
+	if inContainer {
+		fields := strings.Fields(parts[1])
+		if len(fields) == 0 {
+			return fmt.Errorf("hook %q should be of the form event=image [args...]", spec)
+		}
+		hook = &Container{Image: fields[0], Args: fields[1:], Auth: h.Auth}
+	}
+
+	if h.hooks == nil {
+		h.hooks = map[Event][]Hook{}
+	}
+	h.hooks[event] = append(h.hooks[event], hook)
+	return nil
+}
+
+// Has returns true if there are any hooks for `event`.
+func (h *Hooks) Has(event Event) bool {
+	return len(h.hooks[event]) > 0
+}
+
+// Run runs all of the hooks for hc.Event in the order they were added.
+// All hooks are run, the first error encountered is returned.
+func (h *Hooks) Run(client *docker.Client, hc Context) error {
+	var first error
+	for _, hook := range h.hooks[hc.Event] {
+		err := h.run(client, hook, hc)
+		if err != nil {
+			log.Printf("Hook %v on %q for %v-%d failed: %v",
+				hook, hc.Event, hc.App, hc.Generation, err)
+			if first == nil {
+				first = fmt.Errorf("%v hook %v: %v", hc.Event, hook, err)
+			}
+		}
+	}
+	return first
+}
+
+func (h *Hooks) run(client *docker.Client, hook Hook, hc Context) error {
+	ctx := context.Background()
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+
+	log.Printf("Running %q hook: %v", hc.Event, hook)
+	return hook.Run(ctx, client, hc.Env())
+}
@@ -0,0 +1,114 @@
+package hooks
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sensiblecodeio/hanoverd/pkg/registryauth"
+)
+
+func TestAdd(t *testing.T) {
+	for _, tc := range []struct {
+		spec        string
+		inContainer bool
+		event       Event
+		want        Hook // nil if an error is expected
+	}{
+		{"ready=curl localhost", false, Ready, &Command{"curl localhost"}},
+		{"flipped=echo a=b", false, Flipped, &Command{"echo a=b"}},
+		{"going-live=smoke-test:1 --url http://x", true, GoingLive,
+			&Container{Image: "smoke-test:1", Args: []string{"--url", "http://x"}}},
+		{"closed=cleanup", true, Closed, &Container{Image: "cleanup", Args: []string{}}},
+		{"ready", false, "", nil},
+		{"ready=", false, "", nil},
+		{"ready=", true, "", nil},
+		{"ready=   ", true, "", nil},
+		{"started=echo", false, "", nil},
+	} {
+		var h Hooks
+		err := h.Add(tc.spec, tc.inContainer)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", tc.spec, h.hooks)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.spec, err)
+			continue
+		}
+		if got := h.hooks[tc.event]; len(got) != 1 || !reflect.DeepEqual(got[0], tc.want) {
+			t.Errorf("%q: expected %#v, got %#v", tc.spec, tc.want, got)
+		}
+	}
+}
+
+func TestAddContainerAuth(t *testing.T) {
+	auth := &registryauth.Store{}
+	h := Hooks{Auth: auth}
+	err := h.Add("ready=smoke-test:1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The hook's image is pulled with the same credentials as the app's.
+	if got := h.hooks[Ready][0].(*Container).Auth; got != auth {
+		t.Errorf("Expected the hook to have the credentials, got %v", got)
+	}
+}
+
+func TestEnv(t *testing.T) {
+	hc := Context{
+		Event:         Flipped,
+		App:           "app",
+		Generation:    3,
+		Image:         "app:v2",
+		PreviousImage: "app:v1",
+		IPAddress:     "172.17.0.2",
+		Ports:         map[string]string{"8000/tcp": "32768", "53/udp": "32769"},
+	}
+
+	want := []string{
+		"HANOVERD_EVENT=flipped",
+		"HANOVERD_APP=app",
+		"HANOVERD_GENERATION=3",
+		"HANOVERD_IMAGE=app:v2",
+		"HANOVERD_PREVIOUS_IMAGE=app:v1",
+		"HANOVERD_CONTAINER_IP=172.17.0.2",
+		"HANOVERD_CONTAINER_IPV6=",
+		"HANOVERD_PORT_53_UDP=32769",
+		"HANOVERD_PORT_8000_TCP=32768",
+		"HANOVERD_PORTS=53/udp=32769 8000/tcp=32768",
+	}
+	if got := hc.Env(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestVeto(t *testing.T) {
+	var h Hooks
+	for _, spec := range []string{"going-live=exit 1", "ready=exit 1", "flipped=true"} {
+		err := h.Add(spec, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		event  Event
+		fails  bool
+		vetoes bool
+	}{
+		{GoingLive, true, true},
+		{Ready, true, false},
+		{Flipped, false, false},
+		{Closed, false, false},
+	} {
+		err := h.Run(nil, Context{Event: tc.event, App: "app"})
+		if (err != nil) != tc.fails {
+			t.Errorf("%v: expected failure %v, got %v", tc.event, tc.fails, err)
+		}
+		if tc.event.Vetoes() != tc.vetoes {
+			t.Errorf("%v: expected Vetoes() to be %v", tc.event, tc.vetoes)
+		}
+	}
+}
@@ -3,37 +3,110 @@ package iptables
 import (
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+
+	"github.com/sensiblecodeio/hanoverd/pkg/redirect"
+)
+
+var (
+	iptablesPath  = "iptables"
+	ip6tablesPath = "ip6tables"
+
+	// ipv6Unusable is set by Check if ip6tables can't configure the nat
+	// table, in which case IPv6 destinations are skipped.
+	ipv6Unusable bool
 )
 
-var iptablesPath = "iptables"
+// CheckIPTables ensures that `iptables --list` runs without error.
+func CheckIPTables() error {
+	return execIPTables(iptablesPath, "--list")
+}
+
+// Backend is a redirect.Backend which uses iptables.
+type Backend struct{}
+
+func (Backend) Name() string { return "iptables" }
+
+// Check ensures that iptables and iptables-restore work. If those on the
+// $PATH don't, the ones in the working directory are used instead, if they
+// work. If ip6tables can't configure the nat table, IPv6 destinations are
+// skipped.
+func (Backend) Check() error {
+	check := func() error {
+		err := CheckIPTables()
+		if err != nil {
+			return err
+		}
+		return checkRestore(iptablesPath)
+	}
 
-func init() {
-	err := CheckIPTables()
+	err := check()
 	if err != nil {
-		log.Printf("Unable to find iptables, using fallback")
-		wd, err := os.Getwd()
+		wd, wdErr := os.Getwd()
+		if wdErr != nil {
+			return err
+		}
+		log.Printf("Unable to run iptables, trying the one in %v: %v", wd, err)
+		iptablesPath = filepath.Join(wd, "iptables")
+		ip6tablesPath = filepath.Join(wd, "ip6tables")
+		err = check()
 		if err != nil {
-			return
+			return err
 		}
-		iptablesPath = filepath.Join(wd, iptablesPath)
 	}
+
+	err = execIPTables(ip6tablesPath, "--table", "nat", "--list")
+	if err == nil {
+		err = checkRestore(ip6tablesPath)
+	}
+	ipv6Unusable = err != nil
+	if ipv6Unusable {
+		log.Printf("Warning: not redirecting to IPv6 addresses: %v", err)
+	}
+	return nil
 }
 
-// CheckIPTables ensures that `iptables --list` runs without error.
-func CheckIPTables() error {
-	return execIPTables("--list")
+func (Backend) ConfigureRedirects(rs []redirect.Redirect) (func() error, error) {
+	return ConfigureRedirects(rs)
 }
 
-// runIPTables invokes iptables with `args`.
+func (Backend) Reconcile() (int, error) { return Reconcile() }
+
+// Describe returns the iptables commands which would configure `rs`.
+func (Backend) Describe(rs []redirect.Redirect) []string {
+	var commands []string
+	rules := rulesFor(rs)
+	for _, path := range []string{iptablesPath, ip6tablesPath} {
+		for _, r := range rules[path] {
+			commands = append(commands, strings.Join(append(
+				[]string{filepath.Base(path), "--table", "nat", "--insert", r.chain, "1"},
+				r.args...), " "))
+		}
+	}
+	return commands
+}
+
+// IsNFTables returns true if the iptables binary is the nf_tables variant.
+func IsNFTables() bool {
+	out, err := exec.Command(iptablesPath, "--version").Output()
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(out), "nf_tables")
+}
+
+// execIPTables invokes iptables (or ip6tables, according to `path`) with
+// `args`.
 // It appends --wait to the end, ensuring that we don't return before the
 // command takes effect.
 // iptables' stderr is connected to os.Stderr.
-func execIPTables(args ...string) error {
+func execIPTables(path string, args ...string) error {
 	args = append(args, "--wait")
-	cmd := exec.Command(iptablesPath, args...)
+	cmd := exec.Command(path, args...)
 	cmd.Stderr = os.Stderr
 	err := cmd.Run()
 	if err != nil {
@@ -42,78 +115,179 @@ func execIPTables(args ...string) error {
 	return nil
 }
 
-// iptables inserts one IPTables rule.
-// The rule is inserted as the top rule, so if there are multiple matching
-// rules, last-one wins.
-// It returns a function which applies the inverse of the rule.
-func iptables(chain string, args ...string) (func() error, error) {
-	insertArgs := append([]string{"--insert", chain, "1"}, args...)
-	deleteArgs := append([]string{"--delete", chain}, args...)
+// rule is a rule in the nat table.
+type rule struct {
+	chain string
+	args  []string
+}
+
+// insert inserts rules as the top rules of their chains, so if there are
+// multiple matching rules, last-one wins. The rules are inserted with
+// iptables-restore (or ip6tables-restore, according to `path`) as a single
+// transaction, so either all or none of them take effect.
+// It returns a function which deletes them again, also as one transaction.
+// If that fails, for example because one of the rules has already gone, the
+// rules which remain are deleted one at a time.
+func insert(path string, rules []rule) (func() error, error) {
+	var inserts, deletes []string
+	for _, r := range rules {
+		inserts = append(inserts, strings.Join(
+			append([]string{"--insert", r.chain, "1"}, r.args...), " "))
+		deletes = append(deletes, strings.Join(
+			append([]string{"--delete", r.chain}, r.args...), " "))
+	}
 
-	err := execIPTables(insertArgs...)
+	err := restore(path, inserts)
 	if err != nil {
-		// Rule failed to apply. Inverse is now a no-op.
+		// Rules failed to apply. Inverse is now a no-op.
 		noOp := func() error { return nil }
 		return noOp, err
 	}
 
 	inverse := func() error {
-		return execIPTables(deleteArgs...)
+		err := restore(path, deletes)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Removing rules in one transaction failed, removing them one at a time: %v", err)
+		return deleteEach(path, rules)
 	}
 
 	return inverse, nil
 }
 
-func localnetRoutingEnabled() bool {
-	fd, err := os.Open("/proc/sys/net/ipv4/conf/docker0/route_localnet")
+// deleteEach deletes each of `rules` which is still in the nat table. All are
+// attempted, the first error encountered is returned.
+func deleteEach(path string, rules []rule) error {
+	var first error
+	for _, r := range rules {
+		if !exists(path, r) {
+			continue
+		}
+		args := append([]string{"--table", "nat", "--delete", r.chain}, r.args...)
+		err := execIPTables(path, args...)
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// restore applies `lines` to the nat table without flushing it, using the
+// iptables-restore next to the iptables at `path`.
+// --wait ensures that we don't return before the transaction takes effect.
+func restore(path string, lines []string) error {
+	script := "*nat\n" + strings.Join(lines, "\n") + "\nCOMMIT\n"
+	cmd := exec.Command(path+"-restore", "--noflush", "--wait")
+	cmd.Stdin = strings.NewReader(script)
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
 	if err != nil {
-		return false
+		return fmt.Errorf("firewall rules %q failed to apply: %v", script, err)
 	}
-	var routeLocalnet int
-	_, err = fmt.Fscan(fd, &routeLocalnet)
+	return nil
+}
+
+// checkRestore ensures that the iptables-restore next to the iptables at
+// `path` can apply a transaction to the nat table, without changing it.
+func checkRestore(path string) error {
+	cmd := exec.Command(path+"-restore", "--test", "--noflush")
+	cmd.Stdin = strings.NewReader("*nat\nCOMMIT\n")
+	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return false
+		return fmt.Errorf("%v-restore failed: %v: %s", path, err, out)
 	}
-	return routeLocalnet == 1
+	return nil
 }
 
-func localhostRedirect(source, mappedPort int, ip string, target int) []string {
-	if localnetRoutingEnabled() {
+// localhostRedirect returns the rules for locally originated traffic.
+func localhostRedirect(r redirect.Redirect, ip string, v6 bool) [][]string {
+	if !v6 && redirect.LocalnetRoutingEnabled() {
 		// route_localnet is enabled on the docker bridge.
 		// So we can use the same rule as for the remote traffic,
 		// except that the rule is applied on the OUTPUT chain instead
 		// of the PREROUTING chain.
-		return remoteTrafficDNAT(source, ip, target)
+		// (There is no equivalent of route_localnet for IPv6.)
+		// Local traffic isn't subject to the allowed sources.
+		local := r
+		local.AllowedSources = nil
+		return remoteTrafficDNAT(local, ip)
+	}
+	if r.Len() > 1 {
+		// Each port is mapped by docker to an arbitrary port, so each
+		// needs its own REDIRECT.
+		var rules [][]string
+		for _, single := range r.Split() {
+			rules = append(rules, localhostRedirect(single, ip, v6)...)
+		}
+		return rules
 	}
-	return []string{
-		"--table", "nat",
-		"--protocol", "tcp",
+	destination := []string{
 		// Prevent redirection of packets already going to the container
-		"--match", "tcp",
 		"!", "--destination", ip,
 		// Traffic destined for one of the host's interfaces.
 		// Prevent redirection of ports on remote servers
 		// (i.e, don't make google.com:source hit our container)
 		"--match", "addrtype", "--dst-type", "LOCAL",
+	}
+	if r.HostIP != "" {
+		// Only traffic destined for the address the port is bound to.
+		destination = []string{"--destination", r.HostIP}
+	}
+	return [][]string{append(append([]string{
+		"--protocol", r.Protocol,
+		"--match", r.Protocol,
+	}, destination...),
 		// Traffic destined for our source port.
-		"--destination-port", fmt.Sprint(source),
+		"--destination-port", r.SourcePorts(":"),
 		"--jump", "REDIRECT",
-		"--to-ports", fmt.Sprint(mappedPort),
+		"--to-ports", fmt.Sprint(r.MappedPorts[0]),
 		"-m", "comment", "--comment", "hanoverd-localhostRedirect",
-	}
+	)}
 }
 
-func remoteTrafficDNAT(source int, ip string, target int) []string {
-	return []string{
-		"--table", "nat",
-		"--protocol", "tcp",
-		"--match", "tcp",
-		// Traffic destined for one of the host's interfaces.
-		// Prevent redirection of ports on remote servers
-		// (i.e, don't make google.com:source hit our container)
-		"--match", "addrtype", "--dst-type", "LOCAL",
-		// Traffic destined for the source port.
-		"--destination-port", fmt.Sprint(source),
+// remoteTrafficDNAT returns the rules for traffic coming from off-machine.
+func remoteTrafficDNAT(r redirect.Redirect, ip string) [][]string {
+	sources, ok := r.SourcesFor(ip)
+	if !ok {
+		// No remote traffic of this IP version is allowed.
+		return nil
+	}
+
+	to := net.JoinHostPort(ip, fmt.Sprint(r.TargetPort))
+	if r.Len() > 1 {
+		if r.SourcePort != r.TargetPort {
+			// DNAT can only send a range of ports to the same ports,
+			// so each port needs its own rule.
+			var rules [][]string
+			for _, single := range r.Split() {
+				rules = append(rules, remoteTrafficDNAT(single, ip)...)
+			}
+			return rules
+		}
+		// Without a port, DNAT leaves the destination port as it is.
+		to = ip
+	}
+
+	// Traffic destined for one of the host's interfaces.
+	// Prevent redirection of ports on remote servers
+	// (i.e, don't make google.com:source hit our container)
+	destination := []string{"--match", "addrtype", "--dst-type", "LOCAL"}
+	if r.HostIP != "" {
+		// Only traffic destined for the address the port is bound to.
+		destination = []string{"--destination", r.HostIP}
+	}
+	if len(sources) > 0 {
+		// Only traffic from the allowed sources. (iptables adds a rule
+		// for each source.)
+		destination = append(destination, "--source", strings.Join(sources, ","))
+	}
+	return [][]string{append(append([]string{
+		"--protocol", r.Protocol,
+		"--match", r.Protocol,
+	}, destination...),
+		// Traffic destined for the source port(s).
+		"--destination-port", r.SourcePorts(":"),
 		"--jump", "DNAT",
 		// Traditional port forward to ip:port.
 		// (This sends inbound traffic there. Outbound traffic can
@@ -122,12 +296,48 @@ func remoteTrafficDNAT(source int, ip string, target int) []string {
 		//   -t nat -A POSTROUTING -s {ip}/32 -d {ip}/32 -p tcp -m tcp
 		//   --dport {target} -j MASQUERADE
 		// )
-		"--to-destination", fmt.Sprintf("%v:%v", ip, target),
+		// IPv6 addresses are written in [brackets].
+		"--to-destination", to,
 		"-m", "comment", "--comment", "hanoverd-remoteTrafficDNAT",
+	)}
+}
+
+// hostRedirect returns the rules which send traffic to r.TargetPort on the
+// host itself, for remote traffic or for local traffic.
+func hostRedirect(r redirect.Redirect, ip string, remote bool) [][]string {
+	var sources []string
+	if remote {
+		var ok bool
+		sources, ok = r.SourcesFor(ip)
+		if !ok {
+			return nil
+		}
+	}
+
+	destination := []string{"--match", "addrtype", "--dst-type", "LOCAL"}
+	if r.HostIP != "" {
+		destination = []string{"--destination", r.HostIP}
+	}
+	if len(sources) > 0 {
+		destination = append(destination, "--source", strings.Join(sources, ","))
 	}
+	return [][]string{append(append([]string{
+		"--protocol", r.Protocol,
+		"--match", r.Protocol,
+	}, destination...),
+		"--destination-port", r.SourcePorts(":"),
+		"--jump", "REDIRECT",
+		"--to-ports", fmt.Sprint(r.TargetPort),
+		"-m", "comment", "--comment", "hanoverd-hostRedirect",
+	)}
 }
 
-// ConfigureRedirect forwards ports from `source` to `target` using iptables.
+// ConfigureRedirects forwards r.Protocol ("tcp" or "udp") ports from
+// r.SourcePort to r.TargetPort for each of `rs` using iptables, and ip6tables
+// if the container has an IPv6 address. A range of ports is forwarded with a
+// single rule where possible. All of the rules for each of IPv4 and IPv6 are
+// applied in one iptables-restore transaction, so a failure can't leave some
+// ports pointing at one container and some at another.
 // Returns an error and a function which undoes the change to the firewall.
 //
 // Beware, there are multiple pieces involved.
@@ -155,43 +365,78 @@ func remoteTrafficDNAT(source int, ip string, target int) []string {
 // We also take advantage of the fact docker has a MASQUERADE rule which means
 // that packets leaving our machine back towards the remote machine are stamped
 // with the correct return address (that of the host, not the container).
-func ConfigureRedirect(
-	sourcePort, mappedPort int,
-	ipAddress string, targetPort int,
-) (func() error, error) {
-	// PREROUTING rule applies to traffic coming from off-machine.
-	undoPreroute, err := iptables(
-		"PREROUTING",
-		remoteTrafficDNAT(sourcePort, ipAddress, targetPort)...,
-	)
-	if err != nil {
-		return nil, err
-	}
+func ConfigureRedirects(rs []redirect.Redirect) (func() error, error) {
+	rules := rulesFor(rs)
 
-	// OUTPUT rule applies to traffic hitting the `localhost` interface.
-	undoOutput, err := iptables(
-		"OUTPUT",
-		localhostRedirect(sourcePort, mappedPort, ipAddress, targetPort)...,
-	)
-	if err != nil {
-		return nil, err
-	}
+	var undos []func() error
 
 	remove := func() error {
 		// We must apply all inverses.
 		// But we'll cope with only the first error we encounter
 		// being propagated.
-		err1 := undoPreroute()
-		err2 := undoOutput()
+		var first error
+		for _, undo := range undos {
+			if err := undo(); err != nil && first == nil {
+				first = err
+			}
+		}
+		return first
+	}
 
-		if err1 != nil {
-			return err1
+	for _, path := range []string{iptablesPath, ip6tablesPath} {
+		if len(rules[path]) == 0 {
+			continue
 		}
-		if err2 != nil {
-			return err2
+		undo, err := insert(path, rules[path])
+		if err != nil {
+			// Roll back the other family, if it was applied.
+			_ = remove()
+			return nil, err
 		}
-		return nil
+		undos = append(undos, undo)
 	}
 
-	return remove, nil
+	set := track(rules)
+	return func() error {
+		untrack(set)
+		return remove()
+	}, nil
+}
+
+// rulesFor returns the rules for `rs`, by path of iptables or ip6tables.
+func rulesFor(rs []redirect.Redirect) map[string][]rule {
+	rules := map[string][]rule{}
+
+	for _, r := range rs {
+		for _, ip := range r.Destinations() {
+			path, v6 := iptablesPath, redirect.IsIPv6(ip)
+			if v6 {
+				if ipv6Unusable {
+					// Check has warned about it.
+					continue
+				}
+				path = ip6tablesPath
+			}
+
+			if r.ToHost {
+				for _, args := range hostRedirect(r, ip, true) {
+					rules[path] = append(rules[path], rule{"PREROUTING", args})
+				}
+				for _, args := range hostRedirect(r, ip, false) {
+					rules[path] = append(rules[path], rule{"OUTPUT", args})
+				}
+				continue
+			}
+
+			// PREROUTING rules apply to traffic coming from off-machine.
+			for _, args := range remoteTrafficDNAT(r, ip) {
+				rules[path] = append(rules[path], rule{"PREROUTING", args})
+			}
+			// OUTPUT rules apply to traffic hitting the `localhost` interface.
+			for _, args := range localhostRedirect(r, ip, v6) {
+				rules[path] = append(rules[path], rule{"OUTPUT", args})
+			}
+		}
+	}
+	return rules
 }
@@ -0,0 +1,171 @@
+package iptables
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeIPTablesScript is a fake iptables, iptables-restore and iptables-save,
+// which keeps the nat table in $FAKE_IPTABLES_STATE, one rule per line,
+// topmost first. As ip6tables, it keeps it in $FAKE_IPTABLES_STATE.6.
+const fakeIPTablesScript = `#!/bin/sh
+state=$FAKE_IPTABLES_STATE
+case $0 in
+*ip6tables*) state=$state.6 ;;
+esac
+# remove deletes the first line which is exactly $1 from the file $2.
+remove() {
+	awk -v r="$1" '!done && $0 == r { done = 1; next } { print }' "$2" > "$2.new" && mv "$2.new" "$2"
+}
+case " $* " in
+*" --list "*|*" --test "*) exit 0 ;;
+esac
+case $0 in
+*-save)
+	sed 's/^/-A /' "$state" ;;
+*-restore)
+	tmp=$state.tx
+	cp "$state" "$tmp"
+	while read -r op chain rest; do
+		case $op in
+		--insert)
+			{ echo "$chain ${rest#1 }"; cat "$tmp"; } > "$tmp.new" && mv "$tmp.new" "$tmp" ;;
+		--delete)
+			grep -qxF -- "$chain $rest" "$tmp" || { rm "$tmp"; exit 1; }
+			remove "$chain $rest" "$tmp" ;;
+		esac
+	done
+	mv "$tmp" "$state" ;;
+*)
+	shift 2 # --table nat
+	op=$1 chain=$2
+	shift 2
+	rule=$chain
+	while [ $# -gt 1 ]; do rule="$rule $1"; shift; done # up to --wait
+	grep -qxF -- "$rule" "$state" || exit 1
+	[ "$op" = --delete ] && remove "$rule" "$state"
+	exit 0 ;;
+esac
+`
+
+// fakeIPTables puts a fake iptables in place for the duration of the test,
+// returning the file holding its nat table.
+func fakeIPTables(t *testing.T) string {
+	dir := t.TempDir()
+	path, path6 := filepath.Join(dir, "iptables"), filepath.Join(dir, "ip6tables")
+	for _, name := range []string{
+		path, path + "-restore", path + "-save",
+		path6, path6 + "-restore", path6 + "-save",
+	} {
+		err := os.WriteFile(name, []byte(fakeIPTablesScript), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	state := filepath.Join(dir, "nat")
+	for _, name := range []string{state, state + ".6"} {
+		err := os.WriteFile(name, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("FAKE_IPTABLES_STATE", state)
+
+	oldPath, oldPath6 := iptablesPath, ip6tablesPath
+	iptablesPath, ip6tablesPath = path, path6
+	t.Cleanup(func() { iptablesPath, ip6tablesPath = oldPath, oldPath6 })
+	return state
+}
+
+// natTable returns the rules in the fake nat table, topmost first.
+func natTable(t *testing.T, state string) []string {
+	content, err := os.ReadFile(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Fields(strings.ReplaceAll(string(content), " ", "_"))
+}
+
+func TestInsertUndo(t *testing.T) {
+	state := fakeIPTables(t)
+
+	rules := []rule{
+		{"PREROUTING", []string{"--jump", "DNAT", "--to-destination", "172.17.0.2:8000"}},
+		{"OUTPUT", []string{"--jump", "REDIRECT", "--to-ports", "32768"}},
+	}
+	undo, err := insert(iptablesPath, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"OUTPUT_--jump_REDIRECT_--to-ports_32768",
+		"PREROUTING_--jump_DNAT_--to-destination_172.17.0.2:8000",
+	}
+	if got := natTable(t, state); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+
+	// One of the rules has gone, e.g. removed by hand, so the transaction
+	// which deletes both fails. The other must still be removed.
+	err = os.WriteFile(state, []byte("PREROUTING --jump DNAT --to-destination 172.17.0.2:8000\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = undo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := natTable(t, state); len(got) != 0 {
+		t.Errorf("Expected the remaining rule to be removed, got %v", got)
+	}
+}
+
+func TestCheckWithoutIPv6(t *testing.T) {
+	state := fakeIPTables(t)
+	// ip6tables isn't installed.
+	err := os.Remove(ip6tablesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ipv6Unusable = false })
+
+	err = Backend{}.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := hostRedirects(40000)
+	rs[0].IPv6Address = "::1"
+	remove, err := ConfigureRedirects(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := natTable(t, state); len(got) != 2 {
+		t.Errorf("Expected the IPv4 rules, got %v", got)
+	}
+	if got := natTable(t, state+".6"); len(got) != 0 {
+		t.Errorf("Expected no IPv6 rules, got %v", got)
+	}
+
+	err = remove()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckWithoutRestore(t *testing.T) {
+	fakeIPTables(t)
+	// iptables works, but iptables-restore isn't installed.
+	err := os.Remove(iptablesPath + "-restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Backend{}.Check()
+	if err == nil {
+		t.Error("Expected Check to fail without iptables-restore")
+	}
+}
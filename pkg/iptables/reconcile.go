@@ -0,0 +1,216 @@
+package iptables
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ruleSet is the rules inserted by one call to ConfigureRedirects.
+type ruleSet struct {
+	rules map[string][]rule // by path of iptables or ip6tables
+}
+
+// configured are the rule sets which haven't been removed yet, most recent
+// last. The most recent are the rules for the live container.
+var (
+	configuredMu sync.Mutex
+	configured   []*ruleSet
+)
+
+func track(rules map[string][]rule) *ruleSet {
+	configuredMu.Lock()
+	defer configuredMu.Unlock()
+
+	set := &ruleSet{rules}
+	configured = append(configured, set)
+	return set
+}
+
+func untrack(set *ruleSet) {
+	configuredMu.Lock()
+	defer configuredMu.Unlock()
+
+	for i, s := range configured {
+		if s == set {
+			configured = append(configured[:i], configured[i+1:]...)
+			return
+		}
+	}
+}
+
+// Reconcile re-inserts any rules which have gone missing, for example because
+// dockerd or firewalld rebuilt the nat table. Every rule set which is still
+// configured is considered, such as the maintenance page's as well as the
+// live container's. Once a set has been repaired, the sets configured after
+// it are moved back above it, so that the most recent still take precedence.
+// The nat table is read once for each of iptables and ip6tables, with
+// iptables-save.
+// It returns the number of rules which were re-inserted.
+func Reconcile() (int, error) {
+	configuredMu.Lock()
+	defer configuredMu.Unlock()
+
+	tables := map[string]map[string]int{} // by path
+	repaired := 0
+	moved := map[string]bool{} // by path, once a set there has been repaired
+	for _, set := range configured {
+		for path, rules := range set.rules {
+			table, ok := tables[path]
+			if !ok {
+				var err error
+				table, err = save(path)
+				if err != nil {
+					return repaired, err
+				}
+				tables[path] = table
+			}
+
+			var present []rule
+			for _, r := range rules {
+				if take(table, r) {
+					present = append(present, r)
+				}
+			}
+			missing := len(rules) - len(present)
+			if missing == 0 && !moved[path] {
+				continue
+			}
+
+			// The original inverse still removes the re-inserted rules,
+			// since it deletes them by their specification.
+			err := reinsert(path, present, rules)
+			if err != nil {
+				return repaired, err
+			}
+			repaired += missing
+			moved[path] = true
+		}
+	}
+	return repaired, nil
+}
+
+// save returns the keys of the rules in the nat table, counted, according to
+// the iptables-save next to the iptables at `path`.
+func save(path string) (map[string]int, error) {
+	out, err := exec.Command(path+"-save", "--table", "nat").Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v-save failed: %v", path, err)
+	}
+
+	table := map[string]int{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "-A" {
+			continue
+		}
+		for _, key := range ruleKeys(fields[1], fields[2:]) {
+			table[key]++
+		}
+	}
+	return table, nil
+}
+
+// take returns true if all of the rules which `r` stands for are in `table`,
+// and if so removes them, so that each rule in the table is only matched once.
+func take(table map[string]int, r rule) bool {
+	keys := ruleKeys(r.chain, r.args)
+	for _, key := range keys {
+		if table[key] == 0 {
+			return false
+		}
+	}
+	for _, key := range keys {
+		table[key]--
+	}
+	return true
+}
+
+// keyOptions names the options which identify a rule, long and short.
+var keyOptions = map[string]string{
+	"-p":                 "protocol",
+	"--protocol":         "protocol",
+	"--dport":            "dport",
+	"--destination-port": "dport",
+	"--dst-type":         "dst-type",
+	"-j":                 "jump",
+	"--jump":             "jump",
+	"--to-ports":         "to-ports",
+	"--to-destination":   "to-destination",
+	"--comment":          "comment",
+}
+
+// ruleKeys returns a key for each rule which `args` in `chain` stands for,
+// the same whether the args are as given to iptables or as iptables-save
+// writes them: in another order, with long or short options, and with or
+// without a /32 or /128 prefix length on addresses. iptables adds a rule for
+// each of a list of sources.
+func ruleKeys(chain string, args []string) []string {
+	var (
+		parts   []string
+		sources []string
+		negate  string
+	)
+	for i := 0; i+1 < len(args); i++ {
+		option, value := args[i], args[i+1]
+		switch {
+		case option == "!":
+			negate = "!"
+			continue
+		case keyOptions[option] != "":
+			parts = append(parts, keyOptions[option]+"="+strings.Trim(value, `"`))
+		case option == "-d" || option == "--destination":
+			parts = append(parts, negate+"destination="+hostAddress(value))
+		case option == "-s" || option == "--source":
+			for _, source := range strings.Split(value, ",") {
+				sources = append(sources, hostAddress(source))
+			}
+		default:
+			negate = ""
+			continue
+		}
+		negate = ""
+		i++ // the value
+	}
+	sort.Strings(parts)
+	key := chain + " " + strings.Join(parts, " ")
+
+	if len(sources) == 0 {
+		return []string{key}
+	}
+	var keys []string
+	for _, source := range sources {
+		keys = append(keys, key+" source="+source)
+	}
+	return keys
+}
+
+// hostAddress strips the prefix length from a single address.
+func hostAddress(s string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(s, "/32"), "/128")
+}
+
+// reinsert deletes `present` and inserts `rules` at the top of their chains,
+// as a single transaction.
+func reinsert(path string, present, rules []rule) error {
+	var lines []string
+	for _, r := range present {
+		lines = append(lines, strings.Join(
+			append([]string{"--delete", r.chain}, r.args...), " "))
+	}
+	for _, r := range rules {
+		lines = append(lines, strings.Join(
+			append([]string{"--insert", r.chain, "1"}, r.args...), " "))
+	}
+	return restore(path, lines)
+}
+
+// exists returns true if `r` is in the nat table, according to the iptables
+// at `path`.
+func exists(path string, r rule) bool {
+	args := append([]string{"--table", "nat", "--check", r.chain}, r.args...)
+	args = append(args, "--wait")
+	return exec.Command(path, args...).Run() == nil
+}
@@ -0,0 +1,150 @@
+package iptables
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sensiblecodeio/hanoverd/pkg/redirect"
+)
+
+// hostRedirects returns redirects of port 80 to `port` on the host.
+func hostRedirects(port int) []redirect.Redirect {
+	return []redirect.Redirect{{
+		Protocol:    "tcp",
+		SourcePort:  80,
+		MappedPorts: []int{port},
+		IPAddress:   "127.0.0.1",
+		TargetPort:  port,
+		Count:       1,
+		ToHost:      true,
+	}}
+}
+
+func TestReconcile(t *testing.T) {
+	state := fakeIPTables(t)
+	flush := func() {
+		err := os.WriteFile(state, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An older set, e.g. the maintenance page's, beneath the live one.
+	removeOlder, err := ConfigureRedirects(hostRedirects(40000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	removeNewer, err := ConfigureRedirects(hostRedirects(40001))
+	if err != nil {
+		t.Fatal(err)
+	}
+	both := natTable(t, state)
+	if len(both) != 4 {
+		t.Fatalf("Expected 4 rules, got %v", both)
+	}
+
+	// Reconcile reads the table with iptables-save, rather than running
+	// iptables for each rule.
+	err = os.WriteFile(iptablesPath, []byte("#!/bin/sh\nexit 1\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both sets are restored, the newer still above the older.
+	flush()
+	n, err := Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := natTable(t, state); n != 4 || !reflect.DeepEqual(got, both) {
+		t.Errorf("Expected 4 rules restored as %v, got %d: %v", both, n, got)
+	}
+
+	// Re-inserting part of the older set moves the newer back above it.
+	partial := strings.Join(both[:3], "\n")
+	err = os.WriteFile(state, []byte(strings.ReplaceAll(partial, "_", " ")+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := natTable(t, state); n != 1 || !reflect.DeepEqual(got, both) {
+		t.Errorf("Expected 1 rule restored as %v, got %d: %v", both, n, got)
+	}
+
+	// Once the older set is removed, only the newer is restored.
+	err = removeOlder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer := natTable(t, state)
+	if len(newer) != 2 {
+		t.Fatalf("Expected 2 rules, got %v", newer)
+	}
+	flush()
+	n, err = Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := natTable(t, state); n != 2 || !reflect.DeepEqual(got, newer) {
+		t.Errorf("Expected 2 rules restored as %v, got %d: %v", newer, n, got)
+	}
+
+	err = removeNewer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := natTable(t, state); len(got) != 0 {
+		t.Errorf("Expected no rules, got %v", got)
+	}
+}
+
+func TestRuleKeys(t *testing.T) {
+	if redirect.LocalnetRoutingEnabled() {
+		t.Skip("Local traffic is sent with DNAT on this host")
+	}
+	r := redirect.Redirect{
+		Protocol:       "tcp",
+		SourcePort:     80,
+		MappedPorts:    []int{32768},
+		IPAddress:      "172.17.0.2",
+		TargetPort:     8000,
+		Count:          1,
+		AllowedSources: []string{"10.0.0.0/8", "192.0.2.7"},
+	}
+	rules := rulesFor([]redirect.Redirect{r})[iptablesPath]
+
+	// As iptables-save writes them.
+	saved := []string{
+		"-A PREROUTING -s 10.0.0.0/8 -p tcp -m addrtype --dst-type LOCAL -m tcp --dport 80 -m comment --comment hanoverd-remoteTrafficDNAT -j DNAT --to-destination 172.17.0.2:8000",
+		"-A PREROUTING -s 192.0.2.7/32 -p tcp -m addrtype --dst-type LOCAL -m tcp --dport 80 -m comment --comment hanoverd-remoteTrafficDNAT -j DNAT --to-destination 172.17.0.2:8000",
+		"-A OUTPUT ! -d 172.17.0.2/32 -p tcp -m tcp -m addrtype --dst-type LOCAL --dport 80 -m comment --comment hanoverd-localhostRedirect -j REDIRECT --to-ports 32768",
+	}
+	table := map[string]int{}
+	for _, line := range saved {
+		fields := strings.Fields(line)
+		for _, key := range ruleKeys(fields[1], fields[2:]) {
+			table[key]++
+		}
+	}
+
+	for _, r := range rules {
+		if !take(table, r) {
+			t.Errorf("Expected %v to be found among %v", r, saved)
+		}
+	}
+	for key, n := range table {
+		if n != 0 {
+			t.Errorf("Expected %q to be matched", key)
+		}
+	}
+
+	// Once matched, a rule can't be matched again.
+	if take(table, rules[0]) {
+		t.Errorf("Expected %v to be matched once only", rules[0])
+	}
+}
@@ -0,0 +1,285 @@
+// Package nftables redirects traffic to containers using rules in a table of
+// hanoverd's own, so that they don't get mixed up with docker's rules.
+package nftables
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/sensiblecodeio/hanoverd/pkg/redirect"
+)
+
+var nftPath = "nft"
+
+const (
+	// The inet family handles both IPv4 and IPv6.
+	family = "inet"
+	table  = "hanoverd"
+
+	// Run before docker's nat chains (which use the standard dstnat/srcnat
+	// priority of -100), so that our rules take precedence.
+	priority = -101
+)
+
+// Backend is a redirect.Backend which uses nftables.
+type Backend struct{}
+
+func (Backend) Name() string { return "nftables" }
+
+// Check ensures that nft works and that our table and chains exist.
+func (Backend) Check() error {
+	return setup()
+}
+
+func (Backend) ConfigureRedirects(rs []redirect.Redirect) (func() error, error) {
+	return ConfigureRedirects(rs)
+}
+
+func (Backend) Reconcile() (int, error) { return Reconcile() }
+
+// Describe returns the nft commands which would configure `rs`.
+func (Backend) Describe(rs []redirect.Redirect) []string {
+	var commands []string
+	for _, r := range rulesFor(rs) {
+		commands = append(commands, fmt.Sprintf("nft insert rule %s %s %s %s",
+			family, table, r.chain, r.rule))
+	}
+	return commands
+}
+
+// Available returns true if the nft command works.
+func Available() bool {
+	return exec.Command(nftPath, "list", "tables").Run() == nil
+}
+
+// setup creates hanoverd's table and chains if they don't already exist.
+func setup() error {
+	_, err := run(strings.Join([]string{
+		fmt.Sprintf("add table %s %s", family, table),
+		fmt.Sprintf("add chain %s %s prerouting { type nat hook prerouting priority %d; }",
+			family, table, priority),
+		fmt.Sprintf("add chain %s %s output { type nat hook output priority %d; }",
+			family, table, priority),
+	}, "\n"))
+	return err
+}
+
+// run applies `script` as a single atomic transaction, returning the rules
+// which were added, as echoed by nft.
+func run(script string) (string, error) {
+	cmd := exec.Command(nftPath, "--echo", "--handle", "--file", "-")
+	cmd.Stdin = strings.NewReader(script + "\n")
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("nftables transaction %q failed to apply: %v", script, err)
+	}
+	return stdout.String(), nil
+}
+
+var handleRe = regexp.MustCompile(`(?m)^.*?\b(prerouting|output)\b.*# handle (\d+)$`)
+
+// rule is a rule in one of our chains.
+type rule struct {
+	chain, rule string
+}
+
+// insert inserts rules at the top of their chains as a single transaction.
+// It returns the handles nft gave them, in the same order.
+func insert(rules []rule) ([]string, error) {
+	var script []string
+	for _, r := range rules {
+		script = append(script, fmt.Sprintf("insert rule %s %s %s %s",
+			family, table, r.chain, r.rule))
+	}
+
+	out, err := run(strings.Join(script, "\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	var handles []string
+	for _, m := range handleRe.FindAllStringSubmatch(out, -1) {
+		handles = append(handles, m[2])
+	}
+	if len(handles) != len(rules) {
+		return nil, fmt.Errorf(
+			"unable to determine handles of nftables rules from %q", out)
+	}
+	return handles, nil
+}
+
+// remove deletes rules by their handles as a single transaction.
+func remove(rules []rule, handles []string) error {
+	var deletes []string
+	for i, r := range rules {
+		deletes = append(deletes, fmt.Sprintf("delete rule %s %s %s handle %s",
+			family, table, r.chain, handles[i]))
+	}
+	_, err := run(strings.Join(deletes, "\n"))
+	return err
+}
+
+// ipFamily returns the nftables address family (ip or ip6) of `ip`, and the
+// corresponding protocol for meta nfproto.
+func ipFamily(ip string) (family, nfproto string) {
+	if redirect.IsIPv6(ip) {
+		return "ip6", "ipv6"
+	}
+	return "ip", "ipv4"
+}
+
+// remoteTrafficDNAT is a traditional port forward of traffic destined for one
+// of the host's interfaces to the container. See iptables.remoteTrafficDNAT.
+func remoteTrafficDNAT(r redirect.Redirect, ip string) []string {
+	sources, ok := r.SourcesFor(ip)
+	if !ok {
+		// No remote traffic of this IP version is allowed.
+		return nil
+	}
+
+	f, nfproto := ipFamily(ip)
+	to := net.JoinHostPort(ip, fmt.Sprint(r.TargetPort))
+	if r.Len() > 1 {
+		if r.SourcePort != r.TargetPort {
+			// A range can only be sent to the same ports.
+			var rules []string
+			for _, single := range r.Split() {
+				rules = append(rules, remoteTrafficDNAT(single, ip)...)
+			}
+			return rules
+		}
+		// Without a port, dnat leaves the destination port as it is.
+		to = ip
+	}
+
+	destination := fmt.Sprintf("meta nfproto %s fib daddr type local", nfproto)
+	if r.HostIP != "" {
+		// Only traffic destined for the address the port is bound to.
+		destination = fmt.Sprintf("%s daddr %s", f, r.HostIP)
+	}
+	if len(sources) > 0 {
+		// Only traffic from the allowed sources.
+		destination += fmt.Sprintf(" %s saddr { %s }", f, strings.Join(sources, ", "))
+	}
+	return []string{fmt.Sprintf(
+		`%s %s dport %s dnat %s to %s comment "hanoverd-remoteTrafficDNAT"`,
+		destination, r.Protocol, r.SourcePorts("-"), f, to)}
+}
+
+// localhostRedirect sends locally originated traffic to the port mapped by
+// docker (and so via docker's userland proxy), unless route_localnet is
+// enabled, in which case it can be sent directly to the container.
+func localhostRedirect(r redirect.Redirect, ip string) []string {
+	f, _ := ipFamily(ip)
+	if f == "ip" && redirect.LocalnetRoutingEnabled() {
+		// Local traffic isn't subject to the allowed sources.
+		local := r
+		local.AllowedSources = nil
+		return remoteTrafficDNAT(local, ip)
+	}
+
+	destination := fmt.Sprintf("%s daddr != %s fib daddr type local", f, ip)
+	if r.HostIP != "" {
+		destination = fmt.Sprintf("%s daddr %s", f, r.HostIP)
+	}
+
+	// Each port is mapped by docker to an arbitrary port, so a range is
+	// redirected with a map from source port to mapped port.
+	to := fmt.Sprint(r.MappedPorts[0])
+	if r.Len() > 1 {
+		var elements []string
+		for i, mapped := range r.MappedPorts {
+			elements = append(elements, fmt.Sprintf("%d : %d", r.SourcePort+i, mapped))
+		}
+		to = fmt.Sprintf("%s dport map { %s }", r.Protocol, strings.Join(elements, ", "))
+	}
+	return []string{fmt.Sprintf(
+		`%s %s dport %s redirect to :%s comment "hanoverd-localhostRedirect"`,
+		destination, r.Protocol, r.SourcePorts("-"), to)}
+}
+
+// hostRedirect sends traffic to r.TargetPort on the host itself, for remote
+// traffic or for local traffic.
+func hostRedirect(r redirect.Redirect, ip string, remote bool) []string {
+	f, nfproto := ipFamily(ip)
+	destination := fmt.Sprintf("meta nfproto %s fib daddr type local", nfproto)
+	if r.HostIP != "" {
+		destination = fmt.Sprintf("%s daddr %s", f, r.HostIP)
+	}
+	if remote {
+		sources, ok := r.SourcesFor(ip)
+		if !ok {
+			return nil
+		}
+		if len(sources) > 0 {
+			destination += fmt.Sprintf(" %s saddr { %s }", f, strings.Join(sources, ", "))
+		}
+	}
+	return []string{fmt.Sprintf(
+		`%s %s dport %s redirect to :%d comment "hanoverd-hostRedirect"`,
+		destination, r.Protocol, r.SourcePorts("-"), r.TargetPort)}
+}
+
+// ConfigureRedirects forwards r.Protocol ports from r.SourcePort to
+// r.TargetPort for each of `rs`, with the same semantics as
+// iptables.ConfigureRedirects: a PREROUTING DNAT for remote traffic and an
+// OUTPUT redirect for local traffic, for each of the container's IPv4 and IPv6
+// addresses, restricted to r.HostIP if it is set. All rules are applied in one
+// transaction, so either all or none take effect.
+// Returns an error and a function which undoes the change to the firewall.
+func ConfigureRedirects(rs []redirect.Redirect) (func() error, error) {
+	err := setup()
+	if err != nil {
+		return nil, err
+	}
+
+	rules := rulesFor(rs)
+	if len(rules) == 0 {
+		return func() error { return nil }, nil
+	}
+
+	handles, err := insert(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	set := track(rules, handles)
+	inverse := func() error {
+		untrack(set)
+		return remove(set.rules, set.handles)
+	}
+	return inverse, nil
+}
+
+// rulesFor returns the rules for `rs`.
+func rulesFor(rs []redirect.Redirect) []rule {
+	var rules []rule
+	for _, r := range rs {
+		for _, ip := range r.Destinations() {
+			if r.ToHost {
+				for _, prerouting := range hostRedirect(r, ip, true) {
+					rules = append(rules, rule{"prerouting", prerouting})
+				}
+				for _, output := range hostRedirect(r, ip, false) {
+					rules = append(rules, rule{"output", output})
+				}
+				continue
+			}
+			for _, prerouting := range remoteTrafficDNAT(r, ip) {
+				rules = append(rules, rule{"prerouting", prerouting})
+			}
+			for _, output := range localhostRedirect(r, ip) {
+				rules = append(rules, rule{"output", output})
+			}
+		}
+	}
+	return rules
+}
@@ -0,0 +1,119 @@
+package nftables
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ruleSet is the rules inserted by one call to ConfigureRedirects, with the
+// handles nft gave them. The handles change if the rules are re-inserted.
+type ruleSet struct {
+	rules   []rule
+	handles []string
+}
+
+// configured are the rule sets which haven't been removed yet, most recent
+// last. The most recent are the rules for the live container.
+var (
+	configuredMu sync.Mutex
+	configured   []*ruleSet
+)
+
+func track(rules []rule, handles []string) *ruleSet {
+	configuredMu.Lock()
+	defer configuredMu.Unlock()
+
+	set := &ruleSet{rules, handles}
+	configured = append(configured, set)
+	return set
+}
+
+// untrack stops reconciling `set`. Once it returns, set.handles no longer
+// change.
+func untrack(set *ruleSet) {
+	configuredMu.Lock()
+	defer configuredMu.Unlock()
+
+	for i, s := range configured {
+		if s == set {
+			configured = append(configured[:i], configured[i+1:]...)
+			return
+		}
+	}
+}
+
+var (
+	listedRe  = regexp.MustCompile(`(?m)^\s*(.*) # handle (\d+)$`)
+	commentRe = regexp.MustCompile(`comment "hanoverd-[^"]*"`)
+)
+
+// Reconcile re-inserts any rules which have gone missing, for example because
+// the ruleset was flushed by firewalld. A rule is present if a rule with its
+// handle and its hanoverd-* comment is listed. Every rule set which is still
+// configured is considered, such as the maintenance page's as well as the
+// live container's. Once a set has been repaired, the sets configured after
+// it are moved back above it, so that the most recent still take precedence.
+// It returns the number of rules which were re-inserted.
+func Reconcile() (int, error) {
+	configuredMu.Lock()
+	defer configuredMu.Unlock()
+
+	if len(configured) == 0 {
+		return 0, nil
+	}
+
+	// Recreate our table and chains, in case they went too.
+	err := setup()
+	if err != nil {
+		return 0, err
+	}
+
+	out, err := exec.Command(nftPath, "--handle", "list", "table", family, table).Output()
+	if err != nil {
+		return 0, fmt.Errorf("listing nftables rules: %v", err)
+	}
+	listed := map[string]string{} // by handle
+	for _, m := range listedRe.FindAllStringSubmatch(string(out), -1) {
+		listed[m[2]] = m[1]
+	}
+
+	repaired := 0
+	moved := false
+	for _, set := range configured {
+		var (
+			present        []rule
+			presentHandles []string
+		)
+		for i, r := range set.rules {
+			rule, ok := listed[set.handles[i]]
+			if ok && strings.Contains(rule, commentRe.FindString(r.rule)) {
+				present = append(present, r)
+				presentHandles = append(presentHandles, set.handles[i])
+			}
+		}
+		missing := len(set.rules) - len(present)
+		if missing == 0 && !moved {
+			continue
+		}
+
+		// Insert the whole set above the rest before removing what was left
+		// of it, so that its traffic is redirected throughout.
+		handles, err := insert(set.rules)
+		if err != nil {
+			return repaired, err
+		}
+		set.handles = handles
+		if len(present) > 0 {
+			err = remove(present, presentHandles)
+			if err != nil {
+				return repaired, err
+			}
+		}
+		repaired += missing
+		moved = true
+	}
+	return repaired, nil
+}
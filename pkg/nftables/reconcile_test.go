@@ -0,0 +1,172 @@
+package nftables
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sensiblecodeio/hanoverd/pkg/redirect"
+)
+
+// fakeNFTScript is a fake nft, which keeps the rules of our table in
+// $FAKE_NFT_STATE as "chain handle rule", one per line, topmost first.
+const fakeNFTScript = `#!/bin/sh
+state=$FAKE_NFT_STATE
+if [ "$1" = --handle ]; then
+	# --handle list table inet hanoverd
+	while read -r chain handle rule; do
+		printf '\t\t%s # handle %s\n' "$rule" "$handle"
+	done < "$state"
+	exit 0
+fi
+tmp=$state.tx
+cp "$state" "$tmp"
+next=$(cat "$state.next" 2>/dev/null || echo 1)
+while read -r op kind fam tbl chain rest; do
+	case "$op $kind" in
+	"insert rule")
+		{ echo "$chain $next $rest"; cat "$tmp"; } > "$tmp.new" && mv "$tmp.new" "$tmp"
+		echo "insert rule $fam $tbl $chain $rest # handle $next"
+		next=$((next + 1)) ;;
+	"delete rule")
+		handle=${rest#handle }
+		grep -q "^$chain $handle " "$tmp" || { rm "$tmp"; exit 1; }
+		grep -v "^$chain $handle " "$tmp" > "$tmp.new"
+		mv "$tmp.new" "$tmp" ;;
+	esac
+done
+mv "$tmp" "$state"
+echo "$next" > "$state.next"
+`
+
+// fakeNFT puts a fake nft in place for the duration of the test, returning
+// the file holding its rules.
+func fakeNFT(t *testing.T) string {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nft")
+	err := os.WriteFile(path, []byte(fakeNFTScript), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := filepath.Join(dir, "rules")
+	err = os.WriteFile(state, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FAKE_NFT_STATE", state)
+
+	oldPath := nftPath
+	nftPath = path
+	t.Cleanup(func() { nftPath = oldPath })
+	return state
+}
+
+// listRules returns the chain and rule of each rule in the fake table,
+// topmost first, without their handles.
+func listRules(t *testing.T, state string) []string {
+	content, err := os.ReadFile(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rules []string
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) == 3 {
+			rules = append(rules, fields[0]+" "+fields[2])
+		}
+	}
+	return rules
+}
+
+// hostRedirects returns redirects of port 80 to `port` on the host.
+func hostRedirects(port int) []redirect.Redirect {
+	return []redirect.Redirect{{
+		Protocol:    "tcp",
+		SourcePort:  80,
+		MappedPorts: []int{port},
+		IPAddress:   "127.0.0.1",
+		TargetPort:  port,
+		Count:       1,
+		ToHost:      true,
+	}}
+}
+
+func TestReconcile(t *testing.T) {
+	state := fakeNFT(t)
+	flush := func() {
+		err := os.WriteFile(state, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An older set, e.g. the maintenance page's, beneath the live one.
+	removeOlder, err := ConfigureRedirects(hostRedirects(40000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	removeNewer, err := ConfigureRedirects(hostRedirects(40001))
+	if err != nil {
+		t.Fatal(err)
+	}
+	both := listRules(t, state)
+	if len(both) != 4 {
+		t.Fatalf("Expected 4 rules, got %v", both)
+	}
+
+	// Both sets are restored, the newer still above the older.
+	flush()
+	n, err := Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := listRules(t, state); n != 4 || !reflect.DeepEqual(got, both) {
+		t.Errorf("Expected 4 rules restored as %v, got %d: %v", both, n, got)
+	}
+
+	// Re-inserting part of the older set moves the newer back above it.
+	content, err := os.ReadFile(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	err = os.WriteFile(state, []byte(strings.Join(lines[:3], "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := listRules(t, state); n != 1 || !reflect.DeepEqual(got, both) {
+		t.Errorf("Expected 1 rule restored as %v, got %d: %v", both, n, got)
+	}
+
+	// Once the older set is removed, only the newer is restored.
+	err = removeOlder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer := listRules(t, state)
+	if len(newer) != 2 {
+		t.Fatalf("Expected 2 rules, got %v", newer)
+	}
+	flush()
+	n, err = Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := listRules(t, state); n != 2 || !reflect.DeepEqual(got, newer) {
+		t.Errorf("Expected 2 rules restored as %v, got %d: %v", newer, n, got)
+	}
+
+	err = removeNewer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := listRules(t, state); len(got) != 0 {
+		t.Errorf("Expected no rules, got %v", got)
+	}
+}
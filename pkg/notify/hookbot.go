@@ -0,0 +1,69 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Status is published to hookbot each time a container changes state.
+type Status struct {
+	App        string    `json:"app"`
+	Host       string    `json:"host"`
+	Event      string    `json:"event"`
+	Generation int       `json:"generation"`
+	Image      string    `json:"image,omitempty"`
+	SHA        string    `json:"sha,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// Status events.
+const (
+	Started = "started"
+	Ready   = "ready"
+	Live    = "live"
+	Failed  = "failed"
+
+	// Automatic deploys have been locked (or unlocked) for Reason.
+	Locked   = "locked"
+	Unlocked = "unlocked"
+)
+
+// defaultClient is used unless another is given. Requests time out, so that
+// an unresponsive endpoint can't hold up deploys.
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// Hookbot publishes status to a hookbot /pub/ endpoint, so that anything
+// subscribed to the topic can see what is deployed where.
+type Hookbot struct {
+	URL    string
+	Client *http.Client // defaultClient if nil
+}
+
+// Publish sends `s` to the hookbot topic.
+func (h *Hookbot) Publish(s Status) error {
+	body, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	client := h.Client
+	if client == nil {
+		client = defaultClient
+	}
+
+	resp, err := client.Post(h.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("hookbot responded %v", resp.Status)
+	}
+	return nil
+}
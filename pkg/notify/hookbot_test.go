@@ -0,0 +1,88 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHookbotPublish(t *testing.T) {
+	var got map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/pub/status" {
+			t.Errorf("Expected POST /pub/status, got %v %v", r.Method, r.URL.Path)
+		}
+		err := json.NewDecoder(r.Body).Decode(&got)
+		if err != nil {
+			t.Errorf("Failed to decode body: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	h := &Hookbot{URL: ts.URL + "/pub/status"}
+	err := h.Publish(Status{
+		App:        "app",
+		Host:       "host",
+		Event:      Failed,
+		Generation: 2,
+		Error:      "obtain: manifest unknown",
+		Time:       time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"app":        "app",
+		"host":       "host",
+		"event":      "failed",
+		"generation": 2.0,
+		"error":      "obtain: manifest unknown",
+		"time":       "2024-01-02T03:04:05Z",
+	}
+	for k, v := range expected {
+		if got[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, got[k])
+		}
+	}
+	for _, k := range []string{"image", "sha", "reason"} {
+		if _, ok := got[k]; ok {
+			t.Errorf("Expected no %s, got %v", k, got[k])
+		}
+	}
+}
+
+func TestHookbotPublishError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusForbidden)
+	}))
+	defer ts.Close()
+
+	h := &Hookbot{URL: ts.URL}
+	err := h.Publish(Status{App: "app", Event: Live})
+	if err == nil {
+		t.Error("Expected an error when hookbot refuses the status")
+	}
+}
+
+func TestHookbotPublishTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer ts.Close()
+	defer close(hang)
+
+	old := defaultClient
+	defaultClient = &http.Client{Timeout: 50 * time.Millisecond}
+	defer func() { defaultClient = old }()
+
+	// An unresponsive hookbot mustn't block whoever publishes.
+	h := &Hookbot{URL: ts.URL}
+	err := h.Publish(Status{App: "app", Event: Locked})
+	if err == nil {
+		t.Error("Expected Publish to time out")
+	}
+}
@@ -0,0 +1,157 @@
+// Package notify tells the outside world about the outcome of deploys.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+// Outcomes of a deploy.
+const (
+	Success = "success"
+	Failure = "failure"
+)
+
+// Deploy describes the outcome of one attempt to deploy a container.
+type Deploy struct {
+	App           string    `json:"app"`
+	Generation    int       `json:"generation"`
+	Outcome       string    `json:"outcome"`
+	Image         string    `json:"image"`
+	PreviousImage string    `json:"previous_image,omitempty"`
+	Error         string    `json:"error,omitempty"`
+	Time          time.Time `json:"time"`
+
+	// Time spent obtaining the image, starting the container until it was
+	// ready, and in total.
+	ObtainDuration  time.Duration `json:"-"`
+	StartupDuration time.Duration `json:"-"`
+	TotalDuration   time.Duration `json:"-"`
+}
+
+// MarshalJSON represents durations in (fractional) seconds.
+func (d Deploy) MarshalJSON() ([]byte, error) {
+	type deploy Deploy // Avoid recursing into MarshalJSON.
+	return json.Marshal(struct {
+		deploy
+		ObtainSeconds  float64 `json:"obtain_seconds"`
+		StartupSeconds float64 `json:"startup_seconds"`
+		TotalSeconds   float64 `json:"total_seconds"`
+	}{
+		deploy(d),
+		d.ObtainDuration.Seconds(),
+		d.StartupDuration.Seconds(),
+		d.TotalDuration.Seconds(),
+	})
+}
+
+// DefaultSlackTemplate is the message text sent by a Webhook with the
+// "slack" format if no other template is given.
+const DefaultSlackTemplate = `{{if eq .Outcome "success"}}:white_check_mark:{{else}}:x:{{end}} ` +
+	"*{{.App}}* deploy {{.Outcome}}: `{{.Image}}`" +
+	"{{if .Error}}\n```{{.Error}}```{{end}}" +
+	" (obtain {{.ObtainDuration}}, startup {{.StartupDuration}}, total {{.TotalDuration}})"
+
+// Webhook sends a HTTP POST describing each deploy to URL.
+type Webhook struct {
+	URL string
+	// Format of the body, either "json" (the Deploy itself) or "slack" (an
+	// incoming webhook message with Template as its text).
+	Format   string
+	Template *template.Template
+
+	Retries    int
+	RetryDelay time.Duration
+
+	Client *http.Client
+}
+
+// NewWebhook constructs a webhook. If tmpl is empty, the default template is
+// used for the "slack" format.
+func NewWebhook(url, format, tmpl string) (*Webhook, error) {
+	switch format {
+	case "json", "slack":
+	default:
+		return nil, fmt.Errorf("unknown webhook format %q (should be json or slack)", format)
+	}
+
+	if tmpl == "" {
+		tmpl = DefaultSlackTemplate
+	}
+	t, err := template.New("webhook").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("webhook template: %v", err)
+	}
+
+	return &Webhook{
+		URL:        url,
+		Format:     format,
+		Template:   t,
+		Retries:    3,
+		RetryDelay: time.Second,
+		Client:     defaultClient,
+	}, nil
+}
+
+func (w *Webhook) body(d Deploy) ([]byte, error) {
+	if w.Format != "slack" {
+		return json.Marshal(d)
+	}
+
+	var text bytes.Buffer
+	err := w.Template.Execute(&text, d)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]string{"text": text.String()})
+}
+
+// Send posts `d` to the webhook, retrying with exponential backoff on
+// connection errors, timeouts and server errors.
+func (w *Webhook) Send(d Deploy) error {
+	body, err := w.body(d)
+	if err != nil {
+		return err
+	}
+
+	delay := w.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err = w.post(body)
+		if err == nil || attempt >= w.Retries {
+			return err
+		}
+		if _, ok := err.(permanentError); ok {
+			return err
+		}
+
+		log.Printf("Webhook %v failed (attempt %d), retrying in %v: %v",
+			w.URL, attempt+1, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// permanentError is returned for responses which are not worth retrying.
+type permanentError struct{ error }
+
+func (w *Webhook) post(body []byte) error {
+	resp, err := w.Client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("webhook responded %v", resp.Status)
+	default:
+		return permanentError{fmt.Errorf("webhook responded %v", resp.Status)}
+	}
+}
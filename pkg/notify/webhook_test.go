@@ -0,0 +1,136 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookJSON(t *testing.T) {
+	var got map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := json.NewDecoder(r.Body).Decode(&got)
+		if err != nil {
+			t.Errorf("Failed to decode body: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	w, err := NewWebhook(ts.URL, "json", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Send(Deploy{
+		App:            "app",
+		Outcome:        Failure,
+		Image:          "app:1",
+		Error:          "await listening: no status checks succeeded",
+		ObtainDuration: 1500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"app":            "app",
+		"outcome":        "failure",
+		"image":          "app:1",
+		"error":          "await listening: no status checks succeeded",
+		"obtain_seconds": 1.5,
+	}
+	for k, v := range expected {
+		if got[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, got[k])
+		}
+	}
+}
+
+func TestWebhookSlack(t *testing.T) {
+	var got struct{ Text string }
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer ts.Close()
+
+	w, err := NewWebhook(ts.URL, "slack", "{{.App}} {{.Outcome}} {{.Image}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Send(Deploy{App: "app", Outcome: Success, Image: "app:2"})
+	if err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if got.Text != "app success app:2" {
+		t.Errorf("Unexpected slack text: %q", got.Text)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		attempts++
+		if attempts < 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	w, err := NewWebhook(ts.URL, "json", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.RetryDelay = time.Millisecond
+
+	err = w.Send(Deploy{Outcome: Success})
+	if err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+
+	// Client errors are not retried.
+	w.URL = ts.URL + "/missing"
+	ts.Config.Handler = http.NotFoundHandler()
+	err = w.Send(Deploy{Outcome: Success})
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected 404 error, got %v", err)
+	}
+}
+
+func TestWebhookRetriesTimeouts(t *testing.T) {
+	var attempts int32
+	hang := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			<-hang
+		}
+	}))
+	defer ts.Close()
+	defer close(hang)
+
+	w, err := NewWebhook(ts.URL, "json", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.RetryDelay = time.Millisecond
+	w.Client = &http.Client{Timeout: 50 * time.Millisecond}
+
+	// The first attempt times out, the second succeeds.
+	err = w.Send(Deploy{Outcome: Success})
+	if err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if got := atomic.LoadInt32(&attempts); got != 2 {
+		t.Errorf("Expected 2 attempts, got %d", got)
+	}
+}
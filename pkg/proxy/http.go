@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+)
+
+// NewHTTP returns a Proxy which proxies published TCP ports as HTTP. While no
+// container is live, requests are held for up to `hold` rather than failed.
+// Idempotent requests which fail to reach a container (for example, because
+// it is closing) are retried, against whichever container is live by then,
+// for up to `hold` too. UDP ports can't be published.
+func NewHTTP(hold time.Duration) *Proxy {
+	p := New()
+	p.http = true
+	p.hold = hold
+	return p
+}
+
+// errNotLive means no container became live while a request was held.
+var errNotLive = errors.New("no container is live")
+
+// retryDelay is how long to wait before retrying a failed request.
+const retryDelay = 100 * time.Millisecond
+
+// wait returns the address of the live container, waiting until `deadline`
+// for one if there isn't one.
+func (u *upstreams) wait(ctx context.Context, deadline time.Time) (string, error) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	for {
+		u.mu.Lock()
+		if len(u.ups) > 0 {
+			addr := u.ups[len(u.ups)-1].addr
+			u.mu.Unlock()
+			return addr, nil
+		}
+		if u.pushed == nil {
+			u.pushed = make(chan struct{})
+		}
+		pushed := u.pushed
+		u.mu.Unlock()
+
+		select {
+		case <-pushed:
+		case <-timer.C:
+			return "", errNotLive
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+func (p *Proxy) serveHTTP(ln net.Listener, u *upstreams) {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetXForwarded()
+			pr.Out.URL.Scheme = "http"
+			// The host is chosen by the transport, for each attempt.
+		},
+		Transport: &retryTransport{
+			upstreams: u,
+			hold:      p.hold,
+			transport: http.DefaultTransport.(*http.Transport).Clone(),
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("http: %v %v failed: %v", r.Method, r.URL, err)
+			status := http.StatusBadGateway
+			if errors.Is(err, errNotLive) {
+				status = http.StatusServiceUnavailable
+			}
+			w.WriteHeader(status)
+		},
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.mu.Lock()
+		var live *upstream
+		if len(u.ups) > 0 {
+			live = u.ups[len(u.ups)-1]
+		}
+		u.mu.Unlock()
+
+		if live != nil && !live.allows(r.RemoteAddr) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	})
+
+	err := http.Serve(ln, handler)
+	log.Printf("http: serving on %v failed: %v", ln.Addr(), err)
+}
+
+// retryTransport sends requests to the live container, waiting for one if
+// necessary, and retries idempotent requests which fail.
+type retryTransport struct {
+	upstreams *upstreams
+	hold      time.Duration
+	transport http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	deadline := time.Now().Add(t.hold)
+
+	for {
+		addr, err := t.upstreams.wait(ctx, deadline)
+		if err != nil {
+			return nil, err
+		}
+
+		out := req.Clone(ctx)
+		out.URL.Host = addr
+		resp, err := t.transport.RoundTrip(out)
+		if err == nil {
+			return resp, nil
+		}
+
+		if !retryable(req) || time.Now().Add(retryDelay).After(deadline) {
+			return nil, err
+		}
+		log.Printf("http: retrying %v %v: %v", req.Method, req.URL, err)
+
+		select {
+		case <-time.After(retryDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// retryable returns true if `req` can safely be sent again: it's idempotent
+// and has no body which might have been consumed.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody
+}
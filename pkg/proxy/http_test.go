@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sensiblecodeio/hanoverd/pkg/redirect"
+)
+
+// serveHTTP starts an HTTP server which responds with `name`.
+func serveHTTP(t *testing.T, name string) (string, int) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, name)
+	}))
+	t.Cleanup(s.Close)
+
+	host, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
+
+func httpGet(public int) (string, error) {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", public))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	bs, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %v", resp.Status)
+	}
+	return string(bs), nil
+}
+
+func TestHTTPHoldsWhileNothingLive(t *testing.T) {
+	p := NewHTTP(5 * time.Second)
+	public := freePort(t)
+
+	ipA, portA := serveHTTP(t, "a")
+	ipB, portB := serveHTTP(t, "b")
+
+	undoA, err := p.ConfigureRedirects([]redirect.Redirect{{
+		Protocol: "tcp", SourcePort: public, IPAddress: ipA, TargetPort: portA,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := httpGet(public); got != "a" {
+		t.Errorf("Expected a, got %q (%v)", got, err)
+	}
+
+	// Nothing is live, so the request is held until b is.
+	_ = undoA()
+	result := make(chan string)
+	go func() {
+		got, err := httpGet(public)
+		if err != nil {
+			got = err.Error()
+		}
+		result <- got
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	_, err = p.ConfigureRedirects([]redirect.Redirect{{
+		Protocol: "tcp", SourcePort: public, IPAddress: ipB, TargetPort: portB,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-result; got != "b" {
+		t.Errorf("Expected b, got %q", got)
+	}
+}
+
+func TestHTTPRetriesIdempotentRequests(t *testing.T) {
+	p := NewHTTP(5 * time.Second)
+	public := freePort(t)
+
+	// Nothing listens on the dead container's port.
+	_, err := p.ConfigureRedirects([]redirect.Redirect{{
+		Protocol: "tcp", SourcePort: public, IPAddress: "127.0.0.1", TargetPort: freePort(t),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(chan string)
+	go func() {
+		got, err := httpGet(public)
+		if err != nil {
+			got = err.Error()
+		}
+		result <- got
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	ipB, portB := serveHTTP(t, "b")
+	_, err = p.ConfigureRedirects([]redirect.Redirect{{
+		Protocol: "tcp", SourcePort: public, IPAddress: ipB, TargetPort: portB,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-result; got != "b" {
+		t.Errorf("Expected b, got %q", got)
+	}
+}
+
+func TestHTTPGivesUp(t *testing.T) {
+	p := NewHTTP(200 * time.Millisecond)
+	public := freePort(t)
+
+	ip, port := serveHTTP(t, "a")
+	undo, err := p.ConfigureRedirects([]redirect.Redirect{{
+		Protocol: "tcp", SourcePort: public, IPAddress: ip, TargetPort: port,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = undo()
+
+	_, err = httpGet(public)
+	if err == nil || err.Error() != "status 503 Service Unavailable" {
+		t.Errorf("Expected 503, got %v", err)
+	}
+}
@@ -0,0 +1,376 @@
+// Package proxy forwards connections to containers from userspace, as an
+// alternative to firewall rules which needs no special privileges.
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sensiblecodeio/hanoverd/pkg/redirect"
+)
+
+// Proxy is a redirect.Backend which listens on each published port itself and
+// forwards connections to the most recently configured container.
+// Connections which are already established carry on with the container they
+// were made to, so they can finish while an old container is closing.
+type Proxy struct {
+	mu        sync.Mutex
+	listeners map[string]*upstreams // by "host:port/proto"
+
+	// If set, TCP ports are proxied as HTTP. See NewHTTP.
+	http bool
+	hold time.Duration
+}
+
+// New returns a Proxy which isn't listening on anything yet. It listens on
+// ports as redirects are configured for them.
+func New() *Proxy {
+	return &Proxy{listeners: map[string]*upstreams{}}
+}
+
+func (p *Proxy) Name() string {
+	if p.http {
+		return "http"
+	}
+	return "proxy"
+}
+
+// Check always succeeds, a proxy needs no special privileges.
+func (*Proxy) Check() error { return nil }
+
+// Describe returns what the proxy would do to configure `rs`.
+func (*Proxy) Describe(rs []redirect.Redirect) []string {
+	var actions []string
+	for _, r := range rs {
+		destinations := r.Destinations()
+		if len(destinations) == 0 {
+			continue
+		}
+		for _, single := range r.Split() {
+			actions = append(actions, fmt.Sprintf("proxy %v/%v to %v",
+				net.JoinHostPort(single.HostIP, fmt.Sprint(single.SourcePort)),
+				single.Protocol,
+				net.JoinHostPort(destinations[0], fmt.Sprint(single.TargetPort))))
+		}
+	}
+	return actions
+}
+
+// upstream is a container traffic can be sent to.
+type upstream struct {
+	addr string
+	// If set, only clients from these networks may connect.
+	allowed []*net.IPNet
+}
+
+// allows returns true if the client at `from` may connect. Local clients
+// always may.
+func (up *upstream) allows(from string) bool {
+	if len(up.allowed) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(from)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, n := range up.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreams are the containers traffic for one published port can be sent to.
+type upstreams struct {
+	key      string    // in Proxy.listeners
+	listener io.Closer // which serves the port
+
+	mu sync.Mutex
+	// Most recent last. The most recent one receives new connections.
+	ups []*upstream
+	// Closed when an upstream is pushed, if anyone is waiting for one.
+	pushed chan struct{}
+}
+
+// current returns the address new connections from `from` should be sent to,
+// if there is a live container and the client is allowed to connect to it.
+func (u *upstreams) current(from string) (string, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.ups) == 0 {
+		return "", false
+	}
+	up := u.ups[len(u.ups)-1]
+	if !up.allows(from) {
+		return "", false
+	}
+	return up.addr, true
+}
+
+func (u *upstreams) push(up *upstream) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.ups = append(u.ups, up)
+	if u.pushed != nil {
+		close(u.pushed)
+		u.pushed = nil
+	}
+}
+
+func (u *upstreams) remove(up *upstream) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for i, v := range u.ups {
+		if v == up {
+			u.ups = append(u.ups[:i], u.ups[i+1:]...)
+			return
+		}
+	}
+}
+
+// ConfigureRedirects switches new connections on each port of `rs` to the
+// container. All of the ports are listened on before any are switched, so
+// if one can't be listened on, none are switched, and any ports first
+// listened on for this call are closed again. The returned function
+// switches them back to whichever container was configured before, if it's
+// still configured.
+func (p *Proxy) ConfigureRedirects(rs []redirect.Redirect) (func() error, error) {
+	type pending struct {
+		u  *upstreams
+		up *upstream
+	}
+	var (
+		switches []pending
+		opened   []*upstreams
+	)
+	fail := func(err error) (func() error, error) {
+		p.unlisten(opened)
+		return nil, err
+	}
+
+	for _, r := range rs {
+		destinations := r.Destinations()
+		if len(destinations) == 0 {
+			return fail(fmt.Errorf("proxy: no container address to forward %v to", r.SourcePort))
+		}
+
+		var allowed []*net.IPNet
+		for _, source := range r.AllowedSources {
+			_, n, err := net.ParseCIDR(source)
+			if err != nil {
+				return fail(fmt.Errorf("proxy: allowed source: %v", err))
+			}
+			allowed = append(allowed, n)
+		}
+
+		for _, single := range r.Split() {
+			u, created, err := p.listen(single.Protocol, single.HostIP, single.SourcePort)
+			if err != nil {
+				return fail(err)
+			}
+			if created {
+				opened = append(opened, u)
+			}
+			addr := net.JoinHostPort(destinations[0], fmt.Sprint(single.TargetPort))
+			switches = append(switches, pending{u, &upstream{addr, allowed}})
+		}
+	}
+
+	for _, s := range switches {
+		s.u.push(s.up)
+	}
+
+	remove := func() error {
+		for _, s := range switches {
+			s.u.remove(s.up)
+		}
+		return nil
+	}
+	return remove, nil
+}
+
+// listen returns the upstreams for `port` on `hostIP` (all addresses if
+// blank), starting to listen if necessary, in which case `created` is true.
+func (p *Proxy) listen(proto, hostIP string, port int) (u *upstreams, created bool, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	addr := net.JoinHostPort(hostIP, fmt.Sprint(port))
+	key := addr + "/" + proto
+	if u, ok := p.listeners[key]; ok {
+		return u, false, nil
+	}
+
+	u = &upstreams{key: key}
+
+	switch {
+	case proto == "tcp" && p.http:
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, false, fmt.Errorf("proxy: %v", err)
+		}
+		u.listener = ln
+		go p.serveHTTP(ln, u)
+
+	case proto == "tcp":
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, false, fmt.Errorf("proxy: %v", err)
+		}
+		u.listener = ln
+		go serveTCP(ln, u)
+
+	case proto == "udp" && !p.http:
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return nil, false, fmt.Errorf("proxy: %v", err)
+		}
+		u.listener = conn
+		go serveUDP(conn, u)
+
+	default:
+		return nil, false, fmt.Errorf("%v: unsupported protocol %q", p.Name(), proto)
+	}
+
+	p.listeners[key] = u
+	return u, true, nil
+}
+
+// unlisten stops listening on the ports of `us`, which nothing has been
+// switched to.
+func (p *Proxy) unlisten(us []*upstreams) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, u := range us {
+		delete(p.listeners, u.key)
+		err := u.listener.Close()
+		if err != nil {
+			log.Printf("proxy: closing %v: %v", u.key, err)
+		}
+	}
+}
+
+// dialTimeout bounds how long to wait to connect to a container.
+const dialTimeout = 10 * time.Second
+
+func serveTCP(ln net.Listener, u *upstreams) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("proxy: accept on %v failed: %v", ln.Addr(), err)
+			return
+		}
+		go forwardTCP(conn, u)
+	}
+}
+
+func forwardTCP(conn net.Conn, u *upstreams) {
+	defer conn.Close()
+
+	addr, ok := u.current(conn.RemoteAddr().String())
+	if !ok {
+		// Nothing is live, or the client isn't allowed.
+		return
+	}
+
+	up, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		log.Printf("proxy: connecting to %v failed: %v", addr, err)
+		return
+	}
+	defer up.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		copyAndClose(up, conn)
+	}()
+	copyAndClose(conn, up)
+	<-done
+}
+
+// copyAndClose copies from src to dst, then signals EOF to dst, so that each
+// direction can finish independently.
+func copyAndClose(dst, src net.Conn) {
+	_, _ = io.Copy(dst, src)
+	if c, ok := dst.(*net.TCPConn); ok {
+		_ = c.CloseWrite()
+	} else {
+		_ = dst.Close()
+	}
+}
+
+// udpSessionTimeout is how long a UDP "session" with a client lasts after
+// the last packet in either direction.
+const udpSessionTimeout = 30 * time.Second
+
+// serveUDP forwards datagrams. Each client address gets a session, a socket
+// connected to the container which was live when the client's first datagram
+// arrived, so that replies come back from the same place.
+func serveUDP(conn net.PacketConn, u *upstreams) {
+	var (
+		mu       sync.Mutex
+		sessions = map[string]net.Conn{}
+	)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("proxy: read on %v failed: %v", conn.LocalAddr(), err)
+			return
+		}
+
+		mu.Lock()
+		up, ok := sessions[client.String()]
+		if !ok {
+			addr, live := u.current(client.String())
+			if !live {
+				mu.Unlock()
+				continue
+			}
+			up, err = net.Dial("udp", addr)
+			if err != nil {
+				mu.Unlock()
+				log.Printf("proxy: connecting to %v failed: %v", addr, err)
+				continue
+			}
+			sessions[client.String()] = up
+
+			go func(client net.Addr, up net.Conn) {
+				defer func() {
+					mu.Lock()
+					delete(sessions, client.String())
+					mu.Unlock()
+					up.Close()
+				}()
+
+				reply := make([]byte, 64*1024)
+				for {
+					_ = up.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+					n, err := up.Read(reply)
+					if err != nil {
+						return
+					}
+					_, _ = conn.WriteTo(reply[:n], client)
+				}
+			}(client, up)
+		}
+		mu.Unlock()
+
+		_, _ = up.Write(buf[:n])
+	}
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sensiblecodeio/hanoverd/pkg/redirect"
+)
+
+// serve starts a server which writes `name` to each connection.
+func serve(t *testing.T, name string) (string, int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte(name))
+			conn.Close()
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func get(t *testing.T, port int) string {
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	bs, _ := ioutil.ReadAll(conn)
+	return string(bs)
+}
+
+func TestProxySwitchesUpstream(t *testing.T) {
+	p := New()
+	public := freePort(t)
+
+	ipA, portA := serve(t, "a")
+	ipB, portB := serve(t, "b")
+
+	undoA, err := p.ConfigureRedirects([]redirect.Redirect{{
+		Protocol: "tcp", SourcePort: public, IPAddress: ipA, TargetPort: portA,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := get(t, public); got != "a" {
+		t.Errorf("Expected a, got %q", got)
+	}
+
+	undoB, err := p.ConfigureRedirects([]redirect.Redirect{{
+		Protocol: "tcp", SourcePort: public, IPAddress: ipB, TargetPort: portB,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := get(t, public); got != "b" {
+		t.Errorf("Expected b, got %q", got)
+	}
+
+	// Removing the old container's redirect doesn't affect the new one.
+	_ = undoA()
+	if got := get(t, public); got != "b" {
+		t.Errorf("Expected b, got %q", got)
+	}
+
+	_ = undoB()
+	if got := get(t, public); got != "" {
+		t.Errorf("Expected no response with nothing live, got %q", got)
+	}
+}
+
+func TestProxyClosesListenersOnFailure(t *testing.T) {
+	p := New()
+	ip, port := serve(t, "a")
+	free := freePort(t)
+
+	// The second port is already in use.
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	takenPort := taken.Addr().(*net.TCPAddr).Port
+
+	_, err = p.ConfigureRedirects([]redirect.Redirect{
+		{Protocol: "tcp", HostIP: "127.0.0.1", SourcePort: free, IPAddress: ip, TargetPort: port},
+		{Protocol: "tcp", HostIP: "127.0.0.1", SourcePort: takenPort, IPAddress: ip, TargetPort: port},
+	})
+	if err == nil {
+		t.Fatal("Expected listening on a port in use to fail")
+	}
+
+	// The first port was closed again.
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(free)))
+	if err != nil {
+		t.Fatalf("Expected the first port to have been closed: %v", err)
+	}
+	ln.Close()
+	if len(p.listeners) != 0 {
+		t.Errorf("Expected no listeners, got %v", p.listeners)
+	}
+
+	// And can be listened on by a later flip.
+	undo, err := p.ConfigureRedirects([]redirect.Redirect{
+		{Protocol: "tcp", HostIP: "127.0.0.1", SourcePort: free, IPAddress: ip, TargetPort: port},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := get(t, free); got != "a" {
+		t.Errorf("Expected a, got %q", got)
+	}
+	_ = undo()
+}
+
+func TestProxyUDP(t *testing.T) {
+	// An echo server, prefixing replies with "echo:".
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(append([]byte("echo:"), buf[:n]...), addr)
+		}
+	}()
+
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := ln.LocalAddr().(*net.UDPAddr).Port
+	ln.Close()
+
+	p := New()
+	_, err = p.ConfigureRedirects([]redirect.Redirect{{
+		Protocol:   "udp",
+		SourcePort: public,
+		IPAddress:  "127.0.0.1",
+		TargetPort: echo.LocalAddr().(*net.UDPAddr).Port,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(public)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, _ = conn.Write([]byte("ping"))
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("No reply via proxy: %v", err)
+	}
+	if got := string(buf[:n]); got != "echo:ping" {
+		t.Errorf("Expected echo:ping, got %q", got)
+	}
+}
@@ -0,0 +1,35 @@
+package redirect
+
+import "log"
+
+// Describer is a Backend which can describe what it would do to configure
+// redirects.
+type Describer interface {
+	Backend
+	Describe(rs []Redirect) []string
+}
+
+// DryRun is a Backend which logs what another backend would do, without
+// doing it. It needs no privileges.
+type DryRun struct {
+	Backend Describer
+}
+
+func (d DryRun) Name() string { return d.Backend.Name() + " (dry run)" }
+
+func (DryRun) Check() error { return nil }
+
+func (d DryRun) ConfigureRedirects(rs []Redirect) (func() error, error) {
+	described := d.Backend.Describe(rs)
+	for _, action := range described {
+		log.Printf("Dry run: %v", action)
+	}
+
+	remove := func() error {
+		for _, action := range described {
+			log.Printf("Dry run: undo %v", action)
+		}
+		return nil
+	}
+	return remove, nil
+}
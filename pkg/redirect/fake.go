@@ -0,0 +1,78 @@
+package redirect
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Fake is a Backend which records redirects in memory, for testing.
+type Fake struct {
+	// Err, if set, is returned by ConfigureRedirects, which then configures
+	// nothing.
+	Err error
+	// NoIPv6, if set, makes ConfigureRedirects fail for redirects with an
+	// IPv6 address, like a host without ip6tables' nat table.
+	NoIPv6 bool
+
+	mu      sync.Mutex
+	configs []*[]Redirect
+}
+
+func (*Fake) Name() string { return "fake" }
+
+func (*Fake) Check() error { return nil }
+
+func (f *Fake) ConfigureRedirects(rs []Redirect) (func() error, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	if f.NoIPv6 {
+		for _, r := range rs {
+			if r.IPv6Address != "" {
+				return nil, fmt.Errorf("fake: no IPv6 for %v", r.IPv6Address)
+			}
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	config := &rs
+	f.configs = append(f.configs, config)
+
+	remove := func() error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for i, c := range f.configs {
+			if c == config {
+				f.configs = append(f.configs[:i], f.configs[i+1:]...)
+				break
+			}
+		}
+		return nil
+	}
+	return remove, nil
+}
+
+// Configured returns the redirects which are configured and not yet removed,
+// one entry per call to ConfigureRedirects, most recent last.
+func (f *Fake) Configured() [][]Redirect {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var configured [][]Redirect
+	for _, c := range f.configs {
+		configured = append(configured, *c)
+	}
+	return configured
+}
+
+// Live returns the most recently configured redirects, which take precedence
+// over the rest, or nil if there are none.
+func (f *Fake) Live() []Redirect {
+	configured := f.Configured()
+	if len(configured) == 0 {
+		return nil
+	}
+	return configured[len(configured)-1]
+}
@@ -0,0 +1,160 @@
+// Package redirect describes the redirection of traffic for published ports
+// to containers, which is implemented by firewall backends.
+package redirect
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Redirect describes the traffic sent to a container for a range of published
+// ports.
+//
+// Beware, there are multiple ports involved:
+// * SourcePort is where traffic will go to in order to use our service.
+// * MappedPorts are the ports docker chooses on the host for the container.
+// * IPAddress:TargetPort is listened to inside the container.
+//
+// SourcePort and TargetPort are the first of Count consecutive ports, and
+// MappedPorts has one entry for each of them. Count may be zero, meaning one.
+//
+// Traffic is redirected over IPv4 to IPAddress and over IPv6 to IPv6Address,
+// either of which may be blank if the container doesn't have one.
+//
+// If HostIP is set, only traffic destined for that address of the host is
+// redirected, like the host IP in `docker run -p 127.0.0.1:80:8000`.
+//
+// If AllowedSources is set, only remote traffic from those addresses (CIDRs)
+// is redirected. Traffic originating on the host is always redirected.
+//
+// If ToHost is set, traffic is sent to TargetPort on the host itself rather
+// than to a container, from every port in the range. IPAddress and
+// IPv6Address should be the loopback addresses.
+type Redirect struct {
+	// Protocol is "tcp" or "udp".
+	Protocol       string
+	HostIP         string
+	SourcePort     int
+	MappedPorts    []int
+	IPAddress      string
+	IPv6Address    string
+	TargetPort     int
+	Count          int
+	AllowedSources []string
+	ToHost         bool
+}
+
+// Len returns the number of ports in the range.
+func (r Redirect) Len() int {
+	if r.Count < 1 {
+		return 1
+	}
+	return r.Count
+}
+
+// Split returns a single port Redirect for each port in the range.
+func (r Redirect) Split() []Redirect {
+	var rs []Redirect
+	for i := 0; i < r.Len(); i++ {
+		single := r
+		single.SourcePort += i
+		if !r.ToHost {
+			single.TargetPort += i
+		}
+		single.MappedPorts = nil
+		if i < len(r.MappedPorts) {
+			single.MappedPorts = r.MappedPorts[i : i+1]
+		}
+		single.Count = 1
+		rs = append(rs, single)
+	}
+	return rs
+}
+
+// SourcePorts returns the range of source ports as "first<sep>last", or just
+// the port if there is only one.
+func (r Redirect) SourcePorts(sep string) string {
+	if r.Len() == 1 {
+		return fmt.Sprint(r.SourcePort)
+	}
+	return fmt.Sprintf("%d%s%d", r.SourcePort, sep, r.SourcePort+r.Len()-1)
+}
+
+// Destinations returns the container addresses traffic is redirected to.
+// If HostIP is set, only the container address of the same family is used.
+func (r Redirect) Destinations() []string {
+	var ips []string
+	for _, ip := range []string{r.IPAddress, r.IPv6Address} {
+		if ip == "" {
+			continue
+		}
+		if r.HostIP != "" && IsIPv6(ip) != IsIPv6(r.HostIP) {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// SourcesFor returns the allowed sources of the same family as `ip`, or nil
+// if any source is allowed. If only sources of the other family are allowed,
+// ok is false: no remote traffic of this family may be redirected.
+func (r Redirect) SourcesFor(ip string) (sources []string, ok bool) {
+	if len(r.AllowedSources) == 0 {
+		return nil, true
+	}
+	for _, source := range r.AllowedSources {
+		if IsIPv6(source) == IsIPv6(ip) {
+			sources = append(sources, source)
+		}
+	}
+	return sources, len(sources) > 0
+}
+
+// IsIPv6 returns true if `ip` is an IPv6 address.
+func IsIPv6(ip string) bool {
+	return strings.Contains(ip, ":")
+}
+
+// LocalnetRoutingEnabled returns true if route_localnet is enabled on the
+// docker bridge, so that locally originated traffic can be sent to containers
+// in the same way as remote traffic. (There is no equivalent for IPv6.)
+func LocalnetRoutingEnabled() bool {
+	fd, err := os.Open("/proc/sys/net/ipv4/conf/docker0/route_localnet")
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+	var routeLocalnet int
+	_, err = fmt.Fscan(fd, &routeLocalnet)
+	if err != nil {
+		return false
+	}
+	return routeLocalnet == 1
+}
+
+// Backend sends traffic to containers.
+type Backend interface {
+	// Name of the backend, for logging.
+	Name() string
+
+	// Check returns an error if the backend can't be used.
+	Check() error
+
+	// ConfigureRedirects starts redirecting traffic as described by `rs`,
+	// taking precedence over existing redirects for the same ports. Either
+	// all of the redirects take effect or, if there is an error, none do.
+	// It returns a function which undoes the change.
+	ConfigureRedirects(rs []Redirect) (func() error, error)
+}
+
+// Reconciler is implemented by backends whose redirects can be lost when
+// something else rebuilds the firewall, e.g. when dockerd or firewalld
+// restarts.
+type Reconciler interface {
+	// Reconcile restores any of the configured redirects which have gone
+	// missing, keeping their precedence, and returns how many rules it had
+	// to repair.
+	Reconcile() (int, error)
+}
@@ -0,0 +1,199 @@
+// Package registryauth finds credentials for docker registries in the same
+// places as the docker CLI: the "auths" of a docker config.json, and
+// credential helpers named by its "credsStore" and "credHelpers".
+package registryauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/registry"
+)
+
+// The key docker uses for Docker Hub.
+const dockerHub = "https://index.docker.io/v1/"
+
+// helperTimeout is how long a credential helper may take.
+const helperTimeout = 30 * time.Second
+
+// Store is the credentials in a docker config file. A nil *Store has no
+// credentials.
+type Store struct {
+	Path string `json:"-"`
+
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// DefaultPath returns where the docker CLI keeps its config.json.
+func DefaultPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// Load reads the config file at `path`. If `path` is blank the docker CLI's
+// config.json is read, if there is one.
+func Load(path string) (*Store, error) {
+	explicit := path != ""
+	if !explicit {
+		path = DefaultPath()
+	}
+
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return &Store{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{Path: path}
+	err = json.Unmarshal(buf, s)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return s, nil
+}
+
+// Encoded returns the credentials for the registry which `image` is in,
+// encoded for the RegistryAuth of a pull or push. If there are none, an
+// empty set of credentials is encoded, which docker accepts for public
+// registries.
+func (s *Store) Encoded(image string) (string, error) {
+	auth, err := s.Lookup(image)
+	if err != nil {
+		return "", err
+	}
+	return registry.EncodeAuthConfig(auth)
+}
+
+// Lookup returns the credentials for the registry which `image` is in.
+func (s *Store) Lookup(image string) (registry.AuthConfig, error) {
+	host, err := Host(image)
+	if err != nil {
+		return registry.AuthConfig{}, err
+	}
+	if s == nil {
+		return registry.AuthConfig{}, nil
+	}
+
+	key := host
+	if host == "docker.io" {
+		key = dockerHub
+	}
+
+	if helper, ok := s.CredHelpers[host]; ok {
+		return runHelper(helper, key)
+	}
+	if s.CredsStore != "" {
+		return runHelper(s.CredsStore, key)
+	}
+
+	for server, a := range s.Auths {
+		if normalise(server) != host {
+			continue
+		}
+
+		auth := registry.AuthConfig{
+			Username:      a.Username,
+			Password:      a.Password,
+			IdentityToken: a.IdentityToken,
+			ServerAddress: key,
+		}
+		if a.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+			if err != nil {
+				return registry.AuthConfig{}, fmt.Errorf("%v: auth for %v: %v", s.Path, server, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return registry.AuthConfig{}, fmt.Errorf("%v: auth for %v should be user:password", s.Path, server)
+			}
+			auth.Username, auth.Password = parts[0], parts[1]
+		}
+		return auth, nil
+	}
+
+	return registry.AuthConfig{}, nil
+}
+
+// Host returns the registry host of `image`, "docker.io" for Docker Hub.
+func Host(image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", err
+	}
+	return reference.Domain(named), nil
+}
+
+// normalise turns a key of "auths", which may be a URL such as
+// https://index.docker.io/v1/, into a registry host.
+func normalise(server string) string {
+	if i := strings.Index(server, "://"); i >= 0 {
+		server = server[i+3:]
+	}
+	server = strings.SplitN(server, "/", 2)[0]
+	switch server {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+	return server
+}
+
+// runHelper gets the credentials for `server` from docker-credential-`helper`.
+func runHelper(helper, server string) (registry.AuthConfig, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), helperTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String() + string(out))
+		if strings.Contains(msg, "credentials not found") {
+			// Not logged in to this registry.
+			return registry.AuthConfig{}, nil
+		}
+		return registry.AuthConfig{}, fmt.Errorf("docker-credential-%v: %v: %v", helper, err, msg)
+	}
+
+	var creds struct {
+		Username, Secret string
+	}
+	err = json.Unmarshal(out, &creds)
+	if err != nil {
+		return registry.AuthConfig{}, fmt.Errorf("docker-credential-%v: %v", helper, err)
+	}
+
+	auth := registry.AuthConfig{ServerAddress: server}
+	if creds.Username == "<token>" {
+		auth.IdentityToken = creds.Secret
+	} else {
+		auth.Username, auth.Password = creds.Username, creds.Secret
+	}
+	return auth, nil
+}
@@ -0,0 +1,102 @@
+package registryauth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types/registry"
+)
+
+func writeFile(t *testing.T, path, content string, mode os.FileMode) {
+	err := os.WriteFile(path, []byte(content), mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	dir := t.TempDir()
+
+	// A credential helper which knows about one registry.
+	writeFile(t, filepath.Join(dir, "docker-credential-test"), `#!/bin/sh
+read server
+case "$server" in
+registry.example.com) echo '{"ServerURL":"registry.example.com","Username":"helped","Secret":"s3cret"}' ;;
+tokens.example.com) echo '{"ServerURL":"tokens.example.com","Username":"<token>","Secret":"tok"}' ;;
+*) echo "credentials not found in native keychain"; exit 1 ;;
+esac
+`, 0755)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	config := filepath.Join(dir, "config.json")
+	writeFile(t, config, `{
+	"auths": {
+		"https://index.docker.io/v1/": {"auth": "aHViOmh1YnBhc3M="},
+		"localhost:5000": {"username": "local", "password": "pass"}
+	},
+	"credHelpers": {
+		"registry.example.com": "test",
+		"tokens.example.com": "test",
+		"missing.example.com": "test"
+	}
+}`, 0644)
+
+	s, err := Load(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		image string
+		want  registry.AuthConfig
+	}{
+		{"nginx:latest", registry.AuthConfig{
+			Username: "hub", Password: "hubpass", ServerAddress: dockerHub}},
+		{"localhost:5000/app:v1", registry.AuthConfig{
+			Username: "local", Password: "pass", ServerAddress: "localhost:5000"}},
+		{"registry.example.com/group/app", registry.AuthConfig{
+			Username: "helped", Password: "s3cret", ServerAddress: "registry.example.com"}},
+		{"tokens.example.com/app", registry.AuthConfig{
+			IdentityToken: "tok", ServerAddress: "tokens.example.com"}},
+		{"missing.example.com/app", registry.AuthConfig{}},
+		{"other.example.com/app", registry.AuthConfig{}},
+	} {
+		got, err := s.Lookup(tc.image)
+		if err != nil {
+			t.Errorf("%v: %v", tc.image, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%v: expected %+v, got %+v", tc.image, tc.want, got)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	// No config.json is fine unless one was asked for.
+	s, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth, _ := s.Lookup("nginx"); auth != (registry.AuthConfig{}) {
+		t.Errorf("Expected no credentials, got %+v", auth)
+	}
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.json"))
+	if err == nil {
+		t.Errorf("Expected an error for a missing --registry-auth file")
+	}
+
+	// A nil store has no credentials, but still encodes them for a push.
+	var none *Store
+	encoded, err := none.Encoded("localhost:5000/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded != "e30=" {
+		t.Errorf("Expected blank credentials, got %q", encoded)
+	}
+}
@@ -0,0 +1,354 @@
+// Package semver parses semantic versions, such as release tags, and
+// constraints on them.
+package semver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version, e.g. 1.4.2 or 2.0.0-rc.1.
+type Version struct {
+	Major, Minor, Patch int
+	Pre                 string // pre-release, e.g. "rc.1"
+}
+
+// Parse parses a version, with an optional "v" prefix. Missing minor and
+// patch numbers are taken to be zero, and build metadata is ignored.
+func Parse(s string) (Version, error) {
+	v, parts, err := parse(s)
+	if err != nil {
+		return Version{}, err
+	}
+	for _, p := range parts {
+		if p < 0 {
+			return Version{}, fmt.Errorf("version %q: wildcards aren't allowed", s)
+		}
+	}
+	return v, nil
+}
+
+// parse parses a version which may be partial or have wildcards, returning
+// the major, minor and patch numbers given, or -1 for each wildcard.
+func parse(s string) (Version, []int, error) {
+	rest := s
+	if strings.HasPrefix(rest, "v") || strings.HasPrefix(rest, "V") {
+		rest = rest[1:]
+	}
+	if i := strings.Index(rest, "+"); i >= 0 {
+		rest = rest[:i]
+	}
+
+	var v Version
+	if i := strings.Index(rest, "-"); i >= 0 {
+		rest, v.Pre = rest[:i], rest[i+1:]
+		if v.Pre == "" {
+			return Version{}, nil, fmt.Errorf("version %q: empty pre-release", s)
+		}
+	}
+
+	fields := strings.Split(rest, ".")
+	if len(fields) > 3 {
+		return Version{}, nil, fmt.Errorf("version %q: too many parts", s)
+	}
+
+	var parts []int
+	for _, f := range fields {
+		if f == "*" || f == "x" || f == "X" {
+			parts = append(parts, -1)
+			continue
+		}
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return Version{}, nil, fmt.Errorf("version %q: invalid number %q", s, f)
+		}
+		if len(parts) > 0 && parts[len(parts)-1] < 0 {
+			return Version{}, nil, fmt.Errorf("version %q: number after wildcard", s)
+		}
+		parts = append(parts, n)
+	}
+
+	for i, p := range parts {
+		if p < 0 {
+			break
+		}
+		switch i {
+		case 0:
+			v.Major = p
+		case 1:
+			v.Minor = p
+		case 2:
+			v.Patch = p
+		}
+	}
+	return v, parts, nil
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Pre != "" {
+		s += "-" + v.Pre
+	}
+	return s
+}
+
+// Compare returns -1, 0 or 1 if v is less than, equal to or greater than w,
+// by semver precedence.
+func (v Version) Compare(w Version) int {
+	for _, d := range []int{v.Major - w.Major, v.Minor - w.Minor, v.Patch - w.Patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+	switch {
+	case v.Pre == w.Pre:
+		return 0
+	case v.Pre == "":
+		// A release is greater than its pre-releases.
+		return 1
+	case w.Pre == "":
+		return -1
+	}
+
+	a, b := strings.Split(v.Pre, "."), strings.Split(w.Pre, ".")
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareIdentifier(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return sign(len(a) - len(b))
+}
+
+// compareIdentifier compares pre-release identifiers. Numeric ones compare
+// numerically, and are lower than alphanumeric ones.
+func compareIdentifier(a, b string) int {
+	m, errA := strconv.Atoi(a)
+	n, errB := strconv.Atoi(b)
+	switch {
+	case errA == nil && errB == nil:
+		return sign(m - n)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// Constraint restricts versions, e.g. "v2.*", ">=1.4 <2" or "^1.2 || ~0.9".
+type Constraint struct {
+	Spec string
+	// Versions must satisfy every condition of any one alternative.
+	alternatives [][]condition
+}
+
+type condition struct {
+	op string
+	v  Version
+}
+
+// ParseConstraint parses alternatives separated by "||", each of which is
+// a list of conditions separated by spaces or commas. A condition is a
+// version preceded by one of =, !=, >, >=, <, <=, ~ (same minor version)
+// or ^ (same major version). A version on its own, which may be partial or
+// end in a wildcard, matches all of the versions it covers.
+//
+// The syntax is a subset of npm's, and a partial version stands for all of
+// the versions it covers, as it does there. So ">1.4" is ">=1.5.0", not
+// ">1.4.0": nothing in 1.4 matches. Likewise "<=1.4" is "<1.5.0", so 1.4.9
+// matches. As in npm, a pre-release only matches if a condition of the same
+// alternative names a pre-release of the same major, minor and patch
+// version, so ">=2.0.0-rc.1" matches 2.0.0-rc.2 but not 2.1.0-beta.1.
+// Where it differs from npm:
+//
+//   - Conditions may be separated by commas, and != is allowed.
+//   - Hyphen ranges ("1.2 - 1.4") and "~>" aren't supported, and operators
+//     other than = can't be applied to a bare wildcard.
+func ParseConstraint(s string) (Constraint, error) {
+	c := Constraint{Spec: s}
+	for _, alternative := range strings.Split(s, "||") {
+		fields := strings.FieldsFunc(alternative, func(r rune) bool {
+			return r == ' ' || r == '\t' || r == ','
+		})
+		if len(fields) == 0 {
+			return Constraint{}, fmt.Errorf("constraint %q: empty alternative", s)
+		}
+
+		var conditions []condition
+		for i := 0; i < len(fields); i++ {
+			op, version := fields[i], ""
+			if n := strings.IndexFunc(op, notOperator); n >= 0 {
+				op, version = op[:n], op[n:]
+			} else if i+1 < len(fields) {
+				// The operator is separated from its version.
+				i++
+				version = fields[i]
+			}
+
+			cs, err := parseCondition(op, version)
+			if err != nil {
+				return Constraint{}, fmt.Errorf("constraint %q: %v", s, err)
+			}
+			conditions = append(conditions, cs...)
+		}
+		c.alternatives = append(c.alternatives, conditions)
+	}
+	return c, nil
+}
+
+func notOperator(r rune) bool { return !strings.ContainsRune("=!<>~^", r) }
+
+// parseCondition returns the conditions equivalent to `op` applied to `s`.
+func parseCondition(op, s string) ([]condition, error) {
+	v, parts, err := parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	// How many of major, minor and patch were given.
+	given := 0
+	for _, p := range parts {
+		if p < 0 {
+			break
+		}
+		given++
+	}
+
+	// next returns the lowest version beyond those matching the first n
+	// parts of v.
+	next := func(n int) Version {
+		switch n {
+		case 1:
+			return Version{Major: v.Major + 1}
+		case 2:
+			return Version{Major: v.Major, Minor: v.Minor + 1}
+		}
+		return Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1}
+	}
+	if given == 0 {
+		if op != "" && op != "=" {
+			return nil, fmt.Errorf("%q can't be used with a wildcard", op)
+		}
+		return nil, nil
+	}
+	partial := given < 3
+
+	switch op {
+	case "", "=":
+		if !partial {
+			return []condition{{"=", v}}, nil
+		}
+		return []condition{{">=", v}, {"<", next(given)}}, nil
+	case "!=":
+		if partial {
+			return nil, fmt.Errorf("!= needs a full version")
+		}
+		return []condition{{op, v}}, nil
+	case ">", "<=":
+		if partial {
+			// e.g. >1.4 means >=1.5.0
+			op = map[string]string{">": ">=", "<=": "<"}[op]
+			return []condition{{op, next(given)}}, nil
+		}
+		return []condition{{op, v}}, nil
+	case ">=", "<":
+		return []condition{{op, v}}, nil
+	case "~":
+		if given == 1 {
+			return []condition{{">=", v}, {"<", next(1)}}, nil
+		}
+		return []condition{{">=", v}, {"<", next(2)}}, nil
+	case "^":
+		// The upper bound is the next version which changes the left-most
+		// non-zero number.
+		n := 1
+		if v.Major == 0 && given > 1 {
+			n = 2
+			if v.Minor == 0 && given > 2 {
+				n = 3
+			}
+		}
+		return []condition{{">=", v}, {"<", next(n)}}, nil
+	}
+	return nil, fmt.Errorf("unknown operator %q", op)
+}
+
+// Matches returns true if `v` satisfies the constraint.
+func (c Constraint) Matches(v Version) bool {
+	for _, conditions := range c.alternatives {
+		if matchesAll(conditions, v) && (v.Pre == "" || allowsPre(conditions, v)) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsPre returns true if one of `conditions` names a pre-release of the
+// same major, minor and patch version as `v`.
+func allowsPre(conditions []condition, v Version) bool {
+	for _, cond := range conditions {
+		w := cond.v
+		if w.Pre != "" && w.Major == v.Major && w.Minor == v.Minor && w.Patch == v.Patch {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAll(conditions []condition, v Version) bool {
+	for _, cond := range conditions {
+		c := v.Compare(cond.v)
+		var ok bool
+		switch cond.op {
+		case "=":
+			ok = c == 0
+		case "!=":
+			ok = c != 0
+		case ">":
+			ok = c > 0
+		case ">=":
+			ok = c >= 0
+		case "<":
+			ok = c < 0
+		case "<=":
+			ok = c <= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (c Constraint) String() string { return c.Spec }
+
+// Highest returns the highest of `names` which is a version satisfying the
+// constraint, and that version. It returns false if none does.
+func (c Constraint) Highest(names []string) (string, Version, bool) {
+	var (
+		best    string
+		bestV   Version
+		matched bool
+	)
+	for _, name := range names {
+		v, err := Parse(name)
+		if err != nil || !c.Matches(v) {
+			continue
+		}
+		if !matched || v.Compare(bestV) > 0 {
+			best, bestV, matched = name, v, true
+		}
+	}
+	return best, bestV, matched
+}
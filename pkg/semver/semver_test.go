@@ -0,0 +1,106 @@
+package semver
+
+import (
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	// In increasing order.
+	versions := []string{
+		"0.9.0", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta",
+		"1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "v1.0.1",
+		"1.2", "1.10.0", "2",
+	}
+	for i := 1; i < len(versions); i++ {
+		a, err := Parse(versions[i-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := Parse(versions[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Compare(b) != -1 || b.Compare(a) != 1 {
+			t.Errorf("Expected %v < %v", a, b)
+		}
+	}
+
+	for _, bad := range []string{"", "1.x", "1.2.3.4", "1.a", "latest", "1.0-"} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("Expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestConstraint(t *testing.T) {
+	for _, tc := range []struct {
+		constraint string
+		match      []string
+		noMatch    []string
+	}{
+		{"v2.*", []string{"2.0.0", "v2.9.3"}, []string{"1.9.9", "3.0.0", "2.1.0-rc.1"}},
+		{"2.x", []string{"2.0.0", "2.4.1"}, []string{"3.0.0"}},
+		{">=1.4 <2", []string{"1.4.0", "1.9.9"}, []string{"1.3.9", "2.0.0"}},
+		{">= 1.4, < 2", []string{"1.4.0"}, []string{"2.0.0"}},
+		{">1.4", []string{"1.5.0"}, []string{"1.4.9"}},
+		{"<=1.4", []string{"1.4.9"}, []string{"1.5.0"}},
+		{"~1.4.2", []string{"1.4.2", "1.4.9"}, []string{"1.4.1", "1.5.0"}},
+		{"~1", []string{"1.0.0", "1.9.0"}, []string{"2.0.0"}},
+		{"^1.2", []string{"1.2.0", "1.9.0"}, []string{"1.1.9", "2.0.0"}},
+		{"^0.2.3", []string{"0.2.3", "0.2.9"}, []string{"0.3.0"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.4"}},
+		{"1.2.3", []string{"v1.2.3"}, []string{"1.2.4"}},
+		{"!=1.2.3", []string{"1.2.4"}, []string{"1.2.3"}},
+		{"^1.2 || ~0.9", []string{"1.3.0", "0.9.1"}, []string{"0.8.0", "2.0.0"}},
+		{"*", []string{"0.0.1", "9.9.9"}, []string{"1.0.0-rc.1"}},
+		{">=2.0.0-rc.1", []string{"2.0.0-rc.2", "2.0.0", "2.1.0"}, []string{"2.0.0-beta.9", "2.1.0-beta.1"}},
+		{">=1.0.0-rc.1 || >=2.0.0", []string{"1.0.0-rc.2"}, []string{"2.0.0-rc.1"}},
+	} {
+		c, err := ParseConstraint(tc.constraint)
+		if err != nil {
+			t.Errorf("%q: %v", tc.constraint, err)
+			continue
+		}
+		for _, s := range tc.match {
+			if !c.Matches(mustParse(t, s)) {
+				t.Errorf("Expected %q to match %q", tc.constraint, s)
+			}
+		}
+		for _, s := range tc.noMatch {
+			if c.Matches(mustParse(t, s)) {
+				t.Errorf("Expected %q not to match %q", tc.constraint, s)
+			}
+		}
+	}
+
+	for _, bad := range []string{"", ">=", "^1 ||", "!=1.2", ">~1", "1.*.2", "1.2 - 1.4", "~>1.2", ">=*"} {
+		if _, err := ParseConstraint(bad); err == nil {
+			t.Errorf("Expected an error parsing constraint %q", bad)
+		}
+	}
+}
+
+func TestHighest(t *testing.T) {
+	c, err := ParseConstraint(">=1.4 <2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := []string{"v1.3.0", "v1.10.0", "v1.9.0", "v2.0.0", "v1.11.0-rc.1", "release-1", "v1.5"}
+	name, v, ok := c.Highest(tags)
+	if !ok || name != "v1.10.0" || v != (Version{Major: 1, Minor: 10}) {
+		t.Errorf("Expected v1.10.0, got %q %v %v", name, v, ok)
+	}
+
+	if _, _, ok := c.Highest([]string{"v1.0.0", "v2.0.0"}); ok {
+		t.Errorf("Expected no match")
+	}
+}
+
+func mustParse(t *testing.T, s string) Version {
+	v, err := Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
@@ -0,0 +1,188 @@
+package source
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	docker "github.com/docker/docker/client"
+	git "github.com/sensiblecodeio/git-prep-directory"
+
+	"github.com/sensiblecodeio/hanoverd/pkg/semver"
+)
+
+// GitSource builds an image from any git repository which `git clone` can
+// reach, such as a self-hosted server with nested groups, an ssh remote on a
+// non-standard port, a file:// URL or a plain local path.
+type GitSource struct {
+	URL        string
+	InitialRef string
+	// Directory in which to do `docker build`.
+	// Uses repository root if blank.
+	ImageRoot string
+	// If set, deploy the highest tag matching Tags rather than a ref.
+	Tags *semver.Constraint
+
+	mu       sync.Mutex
+	versions map[string]semver.Version // by image name
+}
+
+var (
+	unsafeChars    = regexp.MustCompile("[^a-z0-9._-]+")
+	unsafeTagChars = regexp.MustCompile("[^A-Za-z0-9_.-]+")
+)
+
+// NewGitSource returns a source for the repository at `cloneURL`, which is
+// checked out at `ref` unless a hook payload gives a SHA. Local paths are
+// made absolute, since the mirror is cloned elsewhere.
+func NewGitSource(cloneURL, ref, imageRoot string) (*GitSource, error) {
+	if cloneURL == "" {
+		return nil, fmt.Errorf("git source: no URL given")
+	}
+	if isLocalPath(cloneURL) {
+		abs, err := filepath.Abs(cloneURL)
+		if err != nil {
+			return nil, err
+		}
+		cloneURL = abs
+	}
+	if ref == "" {
+		ref = "HEAD"
+	}
+	return &GitSource{URL: cloneURL, InitialRef: ref, ImageRoot: imageRoot}, nil
+}
+
+// NewGitTagSource returns a source for the repository at `cloneURL` which
+// follows the highest tag matching `constraint`, e.g. "v2.*" or ">=1.4 <2".
+func NewGitTagSource(cloneURL, constraint, imageRoot string) (*GitSource, error) {
+	tags, err := semver.ParseConstraint(constraint)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewGitSource(cloneURL, "", imageRoot)
+	if err != nil {
+		return nil, err
+	}
+	s.Tags = &tags
+	return s, nil
+}
+
+// isLocalPath returns true if `cloneURL` is a path rather than a URL.
+func isLocalPath(cloneURL string) bool {
+	if strings.Contains(cloneURL, "://") {
+		return false
+	}
+	// Like git, treat a colon before the first slash as scp-like syntax,
+	// e.g. git@example.com:group/repo.git
+	colon := strings.Index(cloneURL, ":")
+	slash := strings.Index(cloneURL, "/")
+	return colon < 0 || (slash >= 0 && slash < colon)
+}
+
+// Name returns a name for the repository, suitable for docker images and
+// containers: the last element of its path without any ".git" suffix.
+func (s *GitSource) Name() string {
+	p := s.URL
+	if u, err := url.Parse(p); err == nil && strings.Contains(p, "://") {
+		p = u.Path
+	} else if !isLocalPath(p) {
+		p = p[strings.Index(p, ":")+1:]
+	}
+
+	name := strings.TrimSuffix(path.Base(strings.TrimRight(p, "/")), ".git")
+	name = strings.Trim(unsafeChars.ReplaceAllString(strings.ToLower(name), "-"), "-._")
+	if name == "" {
+		return "git"
+	}
+	return name
+}
+
+// mirrorDir returns where the mirror of the repository is kept, below
+// ./src like GitHostSource's, with one directory per clone URL.
+func (s *GitSource) mirrorDir() string {
+	dir := strings.ToLower(s.URL)
+	dir = strings.TrimPrefix(dir, "file://")
+	dir = unsafeChars.ReplaceAllString(dir, "_")
+	return filepath.Join(".", "src", "git", strings.Trim(dir, "_"))
+}
+
+// Return the git SHA from the given hook payload, if we have a hook payload,
+// otherwise return the InitialRef.
+func (s *GitSource) Ref(payload []byte) string {
+	if sha := PayloadSHA(payload); sha != "" {
+		return sha
+	}
+	return s.InitialRef
+}
+
+func (s *GitSource) Obtain(c *docker.Client, payload []byte) (string, error) {
+	gitDir, err := filepath.Abs(s.mirrorDir())
+	if err != nil {
+		return "", err
+	}
+
+	if s.Tags != nil {
+		return s.obtainTag(c, gitDir)
+	}
+
+	return buildFromGit(c, gitDir, s.URL, s.Ref(payload), s.Name(), s.ImageRoot, "")
+}
+
+// obtainTag builds the highest tag matching s.Tags. Hook payloads only
+// trigger a fresh look at the tags, any SHA they give is ignored.
+func (s *GitSource) obtainTag(c *docker.Client, gitDir string) (string, error) {
+	// Any ref which isn't a SHA causes a fetch.
+	err := git.LocalMirror(s.URL, gitDir, "HEAD", 10*time.Minute, os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	cmd := git.Command(gitDir, "git", "tag", "--list")
+	cmd.Stdout = nil // for cmd.Output
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("list tags: %v", err)
+	}
+
+	tag, version, ok := s.Tags.Highest(strings.Fields(string(out)))
+	if !ok {
+		return "", fmt.Errorf("no tag of %v matches %q", s.URL, s.Tags)
+	}
+	rev, err := git.RevParse(gitDir, tag+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("rev-parse %v: %v", tag, err)
+	}
+	log.Printf("Highest tag matching %q is %v (%v)", s.Tags, tag, rev)
+
+	imageTag := unsafeTagChars.ReplaceAllString(tag, "_")
+	imageName, err := buildFromGit(c, gitDir, s.URL, rev, s.Name(), s.ImageRoot, imageTag)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.versions == nil {
+		s.versions = map[string]semver.Version{}
+	}
+	s.versions[imageName] = version
+	return imageName, nil
+}
+
+// Env gives containers of an image built from a tag its version, as
+// HANOVERD_IMAGE_VERSION.
+func (s *GitSource) Env(imageName string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if version, ok := s.versions[imageName]; ok {
+		return []string{"HANOVERD_IMAGE_VERSION=" + version.String()}
+	}
+	return nil
+}
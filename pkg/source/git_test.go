@@ -0,0 +1,77 @@
+package source
+
+import (
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func TestGitSourceName(t *testing.T) {
+	for _, tc := range []struct{ cloneURL, name string }{
+		{"https://git.example.com/group/sub/App.git", "app"},
+		{"ssh://git@git.example.com:2222/group/app.git/", "app"},
+		{"git@git.example.com:group/app.git", "app"},
+		{"file:///srv/git/app", "app"},
+		{"/srv/git/my app", "my-app"},
+		{"./a:b/app", "app"},
+	} {
+		s := &GitSource{URL: tc.cloneURL}
+		if got := s.Name(); got != tc.name {
+			t.Errorf("%q: expected name %q, got %q", tc.cloneURL, tc.name, got)
+		}
+	}
+}
+
+func TestNewGitSourceLocalPath(t *testing.T) {
+	s, err := NewGitSource("repos/app", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs, _ := filepath.Abs("repos/app")
+	if s.URL != abs || s.InitialRef != "HEAD" {
+		t.Errorf("Expected %q at HEAD, got %q at %q", abs, s.URL, s.InitialRef)
+	}
+
+	s, err = NewGitSource("git@git.example.com:group/app.git", "main", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.URL != "git@git.example.com:group/app.git" {
+		t.Errorf("Expected scp-like URL to be left alone, got %q", s.URL)
+	}
+}
+
+func TestGitSourceFromHookbot(t *testing.T) {
+	u, err := url.Parse("wss://hookbot.example.com/sub/git/" +
+		url.PathEscape("ssh://git@git.example.com:2222/group/sub/app.git") +
+		"/ref/main#docker/web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, imageSource, err := GetSourceFromHookbot(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, ok := imageSource.(*GitSource)
+	if !ok {
+		t.Fatalf("Expected a *GitSource, got %T", imageSource)
+	}
+	if name != "app" ||
+		s.URL != "ssh://git@git.example.com:2222/group/sub/app.git" ||
+		s.InitialRef != "main" || s.ImageRoot != "docker/web" || s.Tags != nil {
+		t.Errorf("Unexpected source %v: %v@%v (imageroot %q)",
+			name, s.URL, s.InitialRef, s.ImageRoot)
+	}
+
+	_, imageSource, err = GetSourceFromHookbot("wss://hookbot.example.com/sub/git/" +
+		url.PathEscape("/srv/git/app") + "/tags/" + url.PathEscape(">=1.4 <2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = imageSource.(*GitSource)
+	if s.URL != "/srv/git/app" || s.Tags == nil || s.Tags.String() != ">=1.4 <2" {
+		t.Errorf("Expected /srv/git/app following >=1.4 <2, got %v following %v",
+			s.URL, s.Tags)
+	}
+}
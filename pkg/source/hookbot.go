@@ -1,6 +1,7 @@
 package source
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/url"
@@ -13,6 +14,11 @@ var (
 		"/branch/([^/#]+)(?:#(.*))?$")
 	hookbotDockerPullSub = regexp.MustCompile("^/sub/docker-pull/(.*)/tag/([^/]+)$")
 	hookbotCwdRe         = regexp.MustCompile("^/sub/hanoverd/cwd$")
+	// The clone URL is path-escaped, e.g. /sub/git/file:%2F%2F%2Fsrv%2Fapp/ref/main,
+	// and may be followed by a ref or by a constraint on the tags to follow.
+	hookbotGitRe = regexp.MustCompile("^/sub/git/([^/]+)/(ref|tags)/([^/#]+)(?:#(.*))?$")
+	// The build context URL is path-escaped, e.g. /sub/context/s3:%2F%2Freleases%2Fapp.tar.gz
+	hookbotContextRe = regexp.MustCompile("^/sub/context/([^/]+)$")
 )
 
 func GetSourceFromHookbot(hookbotURLStr string) (string, ImageSource, error) {
@@ -30,6 +36,12 @@ func GetSourceFromHookbot(hookbotURLStr string) (string, ImageSource, error) {
 	case hookbotDockerPullSub.MatchString(hookbotURL.Path):
 		return NewDockerPullSource(hookbotURL)
 
+	case hookbotGitRe.MatchString(EscapedPathWithFragment(hookbotURL)):
+		return NewGitSourceFromHookbot(hookbotURL)
+
+	case hookbotContextRe.MatchString(hookbotURL.EscapedPath()):
+		return NewURLSourceFromHookbot(hookbotURL)
+
 	case hookbotCwdRe.MatchString(hookbotURL.Path):
 		return "cwd", &CwdSource{}, nil
 	}
@@ -37,6 +49,18 @@ func GetSourceFromHookbot(hookbotURLStr string) (string, ImageSource, error) {
 	return "", nil, fmt.Errorf("Unrecogized hookbot URL %q", hookbotURL.Path)
 }
 
+// PayloadSHA returns the git SHA from a hookbot payload, or "" if it doesn't
+// contain one.
+func PayloadSHA(payload []byte) string {
+	var v struct {
+		SHA string
+	}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return ""
+	}
+	return v.SHA
+}
+
 // Represent the path as /foo or /foo#bar if #bar is specified.
 func PathWithFragment(u *url.URL) string {
 	pathWithFragment := u.Path
@@ -46,6 +70,16 @@ func PathWithFragment(u *url.URL) string {
 	return pathWithFragment
 }
 
+// EscapedPathWithFragment is PathWithFragment, but leaves escaped slashes
+// within the path escaped.
+func EscapedPathWithFragment(u *url.URL) string {
+	pathWithFragment := u.EscapedPath()
+	if u.Fragment != "" {
+		pathWithFragment += "#" + u.Fragment
+	}
+	return pathWithFragment
+}
+
 func NewGitHostSource(hookbotURL *url.URL) (string, ImageSource, error) {
 
 	groups := hookbotGithostRe.FindStringSubmatch(PathWithFragment(hookbotURL))
@@ -82,3 +116,54 @@ func NewDockerPullSource(hookbotURL *url.URL) (string, ImageSource, error) {
 	containerName := path.Base(repository)
 	return containerName, imageSource, nil
 }
+
+func NewGitSourceFromHookbot(hookbotURL *url.URL) (string, ImageSource, error) {
+
+	groups := hookbotGitRe.FindStringSubmatch(EscapedPathWithFragment(hookbotURL))
+	cloneURL, err := url.PathUnescape(groups[1])
+	if err != nil {
+		return "", nil, fmt.Errorf("Hookbot URL clone URL %q does not parse: %v",
+			groups[1], err)
+	}
+	ref, err := url.PathUnescape(groups[3])
+	if err != nil {
+		return "", nil, fmt.Errorf("Hookbot URL %s %q does not parse: %v",
+			groups[2], groups[3], err)
+	}
+	imageRoot := groups[4]
+
+	var imageSource *GitSource
+	if groups[2] == "tags" {
+		imageSource, err = NewGitTagSource(cloneURL, ref, imageRoot)
+	} else {
+		imageSource, err = NewGitSource(cloneURL, ref, imageRoot)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	log.Printf("Hookbot monitoring %v@%v via %v (imageroot %q)",
+		imageSource.URL, ref, hookbotURL.Host, imageRoot)
+
+	return imageSource.Name(), imageSource, nil
+}
+
+func NewURLSourceFromHookbot(hookbotURL *url.URL) (string, ImageSource, error) {
+
+	groups := hookbotContextRe.FindStringSubmatch(hookbotURL.EscapedPath())
+	contextURL, err := url.PathUnescape(groups[1])
+	if err != nil {
+		return "", nil, fmt.Errorf("Hookbot URL context URL %q does not parse: %v",
+			groups[1], err)
+	}
+
+	imageSource, err := NewURLSource(contextURL)
+	if err != nil {
+		return "", nil, err
+	}
+
+	log.Printf("Hookbot monitoring build context %v via %v",
+		contextURL, hookbotURL.Host)
+
+	return imageSource.Name(), imageSource, nil
+}
@@ -9,8 +9,10 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"time"
 
+	"github.com/distribution/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/network"
@@ -20,6 +22,8 @@ import (
 	"github.com/moby/buildkit/frontend/dockerfile/dockerignore"
 	"github.com/moby/patternmatcher"
 	git "github.com/sensiblecodeio/git-prep-directory"
+
+	"github.com/sensiblecodeio/hanoverd/pkg/registryauth"
 )
 
 type ImageSource interface {
@@ -27,6 +31,13 @@ type ImageSource interface {
 	Obtain(client *docker.Client, payload []byte) (string, error)
 }
 
+// EnvSource is an ImageSource which knows more about the images it obtains,
+// to give to their containers as environment variables.
+type EnvSource interface {
+	ImageSource
+	Env(imageName string) []string
+}
+
 type CwdSource struct{}
 
 func (CwdSource) Name() (string, error) {
@@ -65,26 +76,62 @@ func (s *CwdSource) Obtain(c *docker.Client, payload []byte) (string, error) {
 
 type DockerPullSource struct {
 	Repository, Tag string
+	// ImageDigest pins the image, e.g. sha256:..., if it was given by digest.
+	// Tag may then be blank.
+	ImageDigest string
+	// Credentials for the registry, if any.
+	Auth *registryauth.Store
 }
 
-var imageTag = regexp.MustCompile("^([^:]+):?(.*)$")
+// The tag is after the last colon, unless that is part of a registry host.
+var imageTag = regexp.MustCompile("^(.+?)(?::([^:/]+))?$")
 
 // DockerPullSourceFromImage creates a *DockerPullSource from an image name
-// (with an optional tag)
+// (with an optional tag, and optionally pinned by @digest)
 func DockerPullSourceFromImage(image string) *DockerPullSource {
+	// The digest comes last, and itself contains a colon.
+	var digest string
+	if i := strings.LastIndex(image, "@"); i >= 0 {
+		image, digest = image[:i], image[i+1:]
+	}
+
 	parts := imageTag.FindStringSubmatch(image)
-	if len(parts) != 2 {
+	if len(parts) != 3 {
 		log.Panicf("imageTag regexp failed to match %q", image)
 	}
-	image, tag := parts[0], parts[1]
-	return &DockerPullSource{image, tag}
+	image, tag := parts[1], parts[2]
+	if tag == "" && digest == "" {
+		tag = "latest"
+	}
+	return &DockerPullSource{Repository: image, Tag: tag, ImageDigest: digest}
 }
 
-// Obtain an image by pulling a docker image from somewhere.
+// imageName returns the reference to pull, e.g. repo:tag or repo@sha256:...
+func (s *DockerPullSource) imageName() string {
+	name := s.Repository
+	if s.Tag != "" {
+		name += ":" + s.Tag
+	}
+	if s.ImageDigest != "" {
+		name += "@" + s.ImageDigest
+	}
+	return name
+}
+
+// Obtain an image by pulling a docker image from somewhere. The image is
+// returned by its digest, e.g. repo@sha256:..., so that the container runs
+// what was pulled even if the tag moves on in the meantime.
 func (s *DockerPullSource) Obtain(c *docker.Client, payload []byte) (string, error) {
-	imageName := fmt.Sprintf("%s:%s", s.Repository, s.Tag)
+	imageName := s.imageName()
 
-	rc, err := c.ImagePull(context.TODO(), imageName, types.ImagePullOptions{})
+	auth, err := s.Auth.Encoded(imageName)
+	if err != nil {
+		return "", fmt.Errorf("registry auth: %v", err)
+	}
+
+	rc, err := c.ImagePull(context.TODO(), imageName, types.ImagePullOptions{
+		RegistryAuth: auth,
+	})
 	if err != nil {
 		return "", err
 	}
@@ -95,9 +142,68 @@ func (s *DockerPullSource) Obtain(c *docker.Client, payload []byte) (string, err
 		return "", err
 	}
 
+	inspect, _, err := c.ImageInspectWithRaw(context.TODO(), imageName)
+	if err != nil {
+		return "", err
+	}
+	if digest := repoDigest(s.Repository, inspect.RepoDigests); digest != "" {
+		digestName := s.Repository + "@" + digest
+		log.Printf("Pulled %v as %v", imageName, digestName)
+		return digestName, nil
+	}
+
+	// e.g. an image which only exists locally.
+	log.Printf("No digest for %v, running it by tag", imageName)
 	return imageName, nil
 }
 
+// repoDigest returns the digest of `repository` among an image's
+// `repoDigests`, which docker gives in its own normalised form, or "".
+func repoDigest(repository string, repoDigests []string) string {
+	named, err := reference.ParseNormalizedNamed(repository)
+	if err != nil {
+		return ""
+	}
+	for _, rd := range repoDigests {
+		ref, err := reference.ParseNormalizedNamed(rd)
+		if err != nil {
+			continue
+		}
+		canonical, ok := ref.(reference.Canonical)
+		if ok && canonical.Name() == named.Name() {
+			return canonical.Digest().String()
+		}
+	}
+	return ""
+}
+
+// Env gives containers the tag which was pulled, as HANOVERD_IMAGE_TAG, and
+// the digest it resolved to, as HANOVERD_IMAGE_DIGEST.
+func (s *DockerPullSource) Env(imageName string) []string {
+	env := []string{"HANOVERD_IMAGE_TAG=" + s.Tag}
+	if i := strings.LastIndex(imageName, "@"); i >= 0 {
+		env = append(env, "HANOVERD_IMAGE_DIGEST="+imageName[i+1:])
+	}
+	return env
+}
+
+// Digest returns the digest of the manifest the tag currently refers to in
+// the registry, without pulling the image.
+func (s *DockerPullSource) Digest(c *docker.Client) (string, error) {
+	imageName := s.imageName()
+
+	auth, err := s.Auth.Encoded(imageName)
+	if err != nil {
+		return "", fmt.Errorf("registry auth: %v", err)
+	}
+
+	inspect, err := c.DistributionInspect(context.TODO(), imageName, auth)
+	if err != nil {
+		return "", err
+	}
+	return inspect.Descriptor.Digest.String(), nil
+}
+
 type GitHostSource struct {
 	Host          string
 	User          string
@@ -149,14 +255,24 @@ func (s *GitHostSource) Obtain(c *docker.Client, payload []byte) (string, error)
 		return "", err
 	}
 
-	build, err := git.PrepBuildDirectory(gitDir, s.CloneURL(), ref, 10*time.Minute, os.Stderr)
+	return buildFromGit(c, gitDir, s.CloneURL(), ref, s.Repository, s.ImageRoot, "")
+}
+
+// buildFromGit checks out `ref` from a mirror of `cloneURL` in `gitDir` and
+// builds the image from `imageRoot` within it, returning the image's name.
+// The image is tagged with `tag`, or by `git describe` if it is blank.
+func buildFromGit(c *docker.Client, gitDir, cloneURL, ref, repository, imageRoot, tag string) (string, error) {
+	build, err := git.PrepBuildDirectory(gitDir, cloneURL, ref, 10*time.Minute, os.Stderr)
 	if err != nil {
 		return "", err
 	}
 	defer build.Cleanup()
 
-	dockerImage := fmt.Sprintf("%s:%s", s.Repository, build.Name)
-	buildPath := filepath.Join(build.Dir, s.ImageRoot)
+	if tag == "" {
+		tag = build.Name
+	}
+	dockerImage := fmt.Sprintf("%s:%s", repository, tag)
+	buildPath := filepath.Join(build.Dir, imageRoot)
 
 	err = DockerBuildDirectory(c, dockerImage, buildPath)
 	if err != nil {
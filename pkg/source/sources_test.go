@@ -0,0 +1,44 @@
+package source
+
+import (
+	"testing"
+)
+
+func TestDockerPullSourceFromImage(t *testing.T) {
+	const digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	for _, tc := range []struct{ image, repository, tag, digest string }{
+		{"nginx", "nginx", "latest", ""},
+		{"nginx:1.25", "nginx", "1.25", ""},
+		{"localhost:5000/app", "localhost:5000/app", "latest", ""},
+		{"localhost:5000/group/app:v2", "localhost:5000/group/app", "v2", ""},
+		{"nginx@" + digest, "nginx", "", digest},
+		{"nginx:1.25@" + digest, "nginx", "1.25", digest},
+		{"localhost:5000/app@" + digest, "localhost:5000/app", "", digest},
+		{"localhost:5000/group/app:v2@" + digest, "localhost:5000/group/app", "v2", digest},
+	} {
+		s := DockerPullSourceFromImage(tc.image)
+		if s.Repository != tc.repository || s.Tag != tc.tag || s.ImageDigest != tc.digest {
+			t.Errorf("%q: expected %q tag %q digest %q, got %q tag %q digest %q",
+				tc.image, tc.repository, tc.tag, tc.digest, s.Repository, s.Tag, s.ImageDigest)
+		}
+		if got := s.imageName(); got != tc.image && !(tc.tag == "latest" && got == tc.image+":latest") {
+			t.Errorf("%q: expected to pull the same image, got %q", tc.image, got)
+		}
+	}
+}
+
+func TestRepoDigest(t *testing.T) {
+	const digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	repoDigests := []string{
+		"localhost:5000/app@" + digest[:7] + "fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210",
+		"nginx@" + digest,
+	}
+	for _, repository := range []string{"nginx", "docker.io/library/nginx"} {
+		if got := repoDigest(repository, repoDigests); got != digest {
+			t.Errorf("%q: expected %v, got %q", repository, digest, got)
+		}
+	}
+	if got := repoDigest("other", repoDigests); got != "" {
+		t.Errorf("Expected no digest for another repository, got %q", got)
+	}
+}
@@ -0,0 +1,173 @@
+package source
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// TarballSource loads an image from a `docker save` tarball, for sites which
+// can't reach a registry. Path is either the tarball, or a directory in
+// which the newest file is loaded. Compressed tarballs are fine.
+type TarballSource struct {
+	Path string
+}
+
+// Name returns a name for containers of the image: the tarball or
+// directory's name, without extensions, made safe for docker.
+func (s *TarballSource) Name() string {
+	name := filepath.Base(filepath.Clean(s.Path))
+	if i := strings.Index(name, "."); i > 0 {
+		name = name[:i]
+	}
+	name = strings.Trim(unsafeChars.ReplaceAllString(strings.ToLower(name), "-"), "-._")
+	if name == "" {
+		return "image"
+	}
+	return name
+}
+
+// File returns the tarball to load.
+func (s *TarballSource) File() (string, error) {
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return s.Path, nil
+	}
+
+	entries, err := os.ReadDir(s.Path)
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		newest     string
+		newestInfo os.FileInfo
+	)
+	for _, entry := range entries {
+		// Skip hidden files, so that a tarball can be written as a hidden
+		// file and renamed into place once it is complete.
+		if strings.HasPrefix(entry.Name(), ".") || !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// e.g. removed since the directory was read.
+			continue
+		}
+		if newestInfo == nil || info.ModTime().After(newestInfo.ModTime()) {
+			newest, newestInfo = entry.Name(), info
+		}
+	}
+	if newestInfo == nil {
+		return "", fmt.Errorf("no tarballs in %v", s.Path)
+	}
+	return filepath.Join(s.Path, newest), nil
+}
+
+// Latest identifies the tarball which would be loaded now, changing when a
+// newer one appears or it is replaced.
+func (s *TarballSource) Latest() (string, error) {
+	file, err := s.File()
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v (%v, %d bytes)", file, info.ModTime().Format(time.RFC3339Nano), info.Size()), nil
+}
+
+// Obtain loads the tarball into docker, returning the name of the image in
+// it.
+func (s *TarballSource) Obtain(c *docker.Client, payload []byte) (string, error) {
+	file, err := s.File()
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	log.Printf("Loading image from %v", file)
+	resp, err := c.ImageLoad(context.TODO(), f, true)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	imageName, err := loadedImage(resp.Body, resp.JSON)
+	if err != nil {
+		return "", fmt.Errorf("load %v: %v", file, err)
+	}
+	log.Printf("Loaded %v from %v", imageName, file)
+	return imageName, nil
+}
+
+// loadedImage reads the output of an image load, returning the name of the
+// image loaded, or its ID if it has no name. If the tarball holds more than
+// one image the first is used.
+func loadedImage(r io.Reader, isJSON bool) (string, error) {
+	var lines []string
+	if isJSON {
+		dec := json.NewDecoder(r)
+		for {
+			var msg jsonmessage.JSONMessage
+			err := dec.Decode(&msg)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+			if msg.Error != nil {
+				return "", msg.Error
+			}
+			lines = append(lines, strings.Split(msg.Stream, "\n")...)
+		}
+	} else {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return "", err
+		}
+	}
+
+	var names, ids []string
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "Loaded image ID: "):
+			ids = append(ids, strings.TrimPrefix(line, "Loaded image ID: "))
+		case strings.HasPrefix(line, "Loaded image: "):
+			names = append(names, strings.TrimPrefix(line, "Loaded image: "))
+		}
+	}
+
+	loaded := append(names, ids...)
+	if len(loaded) == 0 {
+		return "", fmt.Errorf("no image loaded")
+	}
+	if len(loaded) > 1 {
+		log.Printf("Tarball has %d images, using %v: %v", len(loaded), loaded[0], loaded)
+	}
+	return loaded[0], nil
+}
@@ -0,0 +1,108 @@
+package source
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadedImage(t *testing.T) {
+	for _, tc := range []struct {
+		output string
+		isJSON bool
+		want   string
+	}{
+		{`{"stream":"Loaded image: app:v1.2\n"}` + "\n", true, "app:v1.2"},
+		{`{"stream":"Loaded image ID: sha256:0123\n"}`, true, "sha256:0123"},
+		{`{"stream":"Loaded image ID: sha256:0123\n"}{"stream":"Loaded image: app:v1\n"}`, true, "app:v1"},
+		{"Loaded image: localhost:5000/app:v1\nLoaded image: app:latest\n", false, "localhost:5000/app:v1"},
+	} {
+		got, err := loadedImage(strings.NewReader(tc.output), tc.isJSON)
+		if err != nil {
+			t.Errorf("%q: %v", tc.output, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: expected %q, got %q", tc.output, tc.want, got)
+		}
+	}
+
+	_, err := loadedImage(strings.NewReader(`{"errorDetail":{"message":"bad tar"},"error":"bad tar"}`), true)
+	if err == nil || !strings.Contains(err.Error(), "bad tar") {
+		t.Errorf("Expected the load error, got %v", err)
+	}
+	_, err = loadedImage(strings.NewReader(""), false)
+	if err == nil {
+		t.Errorf("Expected an error when nothing was loaded")
+	}
+}
+
+func TestTarballSourceNewest(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "app.images")
+	err := os.Mkdir(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &TarballSource{Path: dir}
+	if s.Name() != "app" {
+		t.Errorf("Expected name app, got %q", s.Name())
+	}
+	if _, err := s.File(); err == nil {
+		t.Errorf("Expected an error for an empty directory")
+	}
+
+	now := time.Now()
+	for i, name := range []string{"v1.tar", "v2.tar.gz", ".v3.tar.partial"} {
+		path := filepath.Join(dir, name)
+		err := os.WriteFile(path, []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(time.Duration(i) * time.Minute)
+		err = os.Chtimes(path, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := s.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "v2.tar.gz"); file != want {
+		t.Errorf("Expected %v, got %v", want, file)
+	}
+
+	before, err := s.Latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(filepath.Join(dir, ".v3.tar.partial"), filepath.Join(dir, "v3.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := s.Latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == after || !strings.Contains(after, "v3.tar") {
+		t.Errorf("Expected the renamed tarball to be newest, got %v then %v", before, after)
+	}
+}
+
+func TestTarballSourceName(t *testing.T) {
+	for path, want := range map[string]string{
+		"/srv/images/app.tar.gz":     "app",
+		"/srv/images/My App (2).tar": "my-app-2",
+		"/srv/images/_Site_/":        "site",
+		"/srv/images/---.tar":        "image",
+		"/":                          "image",
+	} {
+		if got := (&TarballSource{Path: path}).Name(); got != want {
+			t.Errorf("%q: expected name %q, got %q", path, want, got)
+		}
+	}
+}
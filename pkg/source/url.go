@@ -0,0 +1,244 @@
+package source
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// fetchTimeout is how long fetching a build context may take.
+const fetchTimeout = 10 * time.Minute
+
+// URLSource builds an image from a tarball of a build context, fetched from
+// an http(s):// URL or from s3://bucket/key. The tarball may be compressed,
+// as for `docker build URL`.
+//
+// A hook payload may give a different URL to fetch, and the SHA-256 the
+// tarball must have:
+//
+//	{"URL": "s3://releases/app-1.4.2.tar.gz", "SHA256": "..."}
+//
+// The payload's URL must have the same scheme and host (or bucket) as URL,
+// so that whoever can send hooks can't have other content deployed, or have
+// other buckets read with hanoverd's credentials.
+type URLSource struct {
+	URL string
+
+	// For s3:// URLs. Endpoint is blank for AWS itself, or the URL of an
+	// S3-compatible store such as MinIO, which is addressed path-style.
+	// Requests are unsigned if there is no AccessKeyID.
+	S3Endpoint string
+	S3         s3Credentials
+}
+
+// NewURLSource returns a source for the build context at `contextURL`,
+// taking S3 settings from the environment variables used by the AWS CLI.
+func NewURLSource(contextURL string) (*URLSource, error) {
+	u, err := url.Parse(contextURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "s3":
+	default:
+		return nil, fmt.Errorf("build context URL %q should be http(s):// or s3://", contextURL)
+	}
+
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &URLSource{
+		URL:        contextURL,
+		S3Endpoint: os.Getenv("AWS_ENDPOINT_URL"),
+		S3: s3Credentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			Region:          region,
+		},
+	}, nil
+}
+
+// Name returns a name for the image: the tarball's name, without
+// extensions.
+func (s *URLSource) Name() string {
+	name := path.Base(s.URL)
+	if u, err := url.Parse(s.URL); err == nil {
+		name = path.Base(u.Path)
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		name = name[:i]
+	}
+	name = strings.Trim(unsafeChars.ReplaceAllString(strings.ToLower(name), "-"), "-._")
+	if name == "" {
+		return "context"
+	}
+	return name
+}
+
+// urlPayload is what a hook payload may tell a URLSource.
+type urlPayload struct {
+	URL    string
+	SHA256 string
+}
+
+func (s *URLSource) Obtain(c *docker.Client, payload []byte) (string, error) {
+	contextURL := s.URL
+	var want string
+	if len(payload) > 0 {
+		var p urlPayload
+		err := json.Unmarshal(payload, &p)
+		if err != nil {
+			return "", fmt.Errorf("payload: %v", err)
+		}
+		if p.URL != "" {
+			err = s.allowed(p.URL)
+			if err != nil {
+				return "", fmt.Errorf("payload: %v", err)
+			}
+			contextURL = p.URL
+		}
+		want = strings.ToLower(p.SHA256)
+	}
+
+	// The context is kept on disk so that it can be checked before docker
+	// sees any of it.
+	f, err := os.CreateTemp("", "hanoverd-context-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := sha256.New()
+	err = s.fetch(contextURL, io.MultiWriter(f, h))
+	if err != nil {
+		return "", fmt.Errorf("fetch %v: %v", contextURL, err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if want != "" && sum != want {
+		return "", fmt.Errorf("%v has SHA-256 %v, expected %v", contextURL, sum, want)
+	}
+	log.Printf("Fetched build context %v (SHA-256 %v)", contextURL, sum)
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	imageName := fmt.Sprintf("%s:%s", s.Name(), sum[:12])
+	resp, err := c.ImageBuild(context.TODO(), f, types.ImageBuildOptions{
+		Remove: true,
+		Tags:   []string{imageName},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	err = jsonmessage.DisplayJSONMessagesStream(resp.Body, os.Stderr, 0, false, nil)
+	if err != nil {
+		return "", err
+	}
+	return imageName, nil
+}
+
+// allowed returns an error unless `contextURL` has the same scheme, host (or
+// bucket) and user as s.URL.
+func (s *URLSource) allowed(contextURL string) error {
+	configured, err := url.Parse(s.URL)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(contextURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != configured.Scheme || !strings.EqualFold(u.Host, configured.Host) ||
+		u.User.String() != configured.User.String() || u.Opaque != "" {
+		return fmt.Errorf("%q is not at %v://%v", contextURL, configured.Scheme, configured.Host)
+	}
+	return nil
+}
+
+// fetch writes the content at `contextURL` to `w`.
+func (s *URLSource) fetch(contextURL string, w io.Writer) error {
+	u, err := url.Parse(contextURL)
+	if err != nil {
+		return err
+	}
+	isS3 := u.Scheme == "s3"
+	if isS3 {
+		u, err = s.s3URL(u)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if isS3 && s.S3.AccessKeyID != "" {
+		s.S3.sign(req, time.Now())
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%v: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// s3URL returns the https URL of the object at s3://bucket/key.
+func (s *URLSource) s3URL(u *url.URL) (*url.URL, error) {
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("%v should be s3://bucket/key", u)
+	}
+
+	endpoint := s.S3Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.S3.Region)
+	}
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("S3 endpoint %q: %v", endpoint, err)
+	}
+
+	// Path-style, which S3-compatible stores all support.
+	u = base.JoinPath(bucket, key)
+	// Send the path encoded exactly as it is signed.
+	u.RawPath = canonicalPath(u.Path)
+	return u, nil
+}
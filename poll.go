@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/sensiblecodeio/barrier"
+)
+
+// poll calls `current` every `interval` and queues an automatic deploy
+// whenever what it returns changes, until `dying` falls. It is an
+// alternative to hookbot for image sources which can't notify us, such as a
+// registry (`current` gives the digest of the tag) or a directory of image
+// tarballs (the newest file). `what` names the source in logs.
+func poll(what string, current func() (string, error), interval time.Duration, queue *eventQueue, dying *barrier.Barrier) {
+	last, err := current()
+	if err != nil {
+		// Deploy as soon as the source is available, since obtaining the
+		// image at startup will have failed too.
+		log.Printf("Poll %v: %v", what, err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-dying.Barrier():
+			return
+		}
+
+		now, err := current()
+		if err != nil {
+			log.Printf("Poll %v: %v", what, err)
+			continue
+		}
+		if now == last {
+			continue
+		}
+
+		log.Printf("Poll %v: now %v (was %q), deploying", what, now, last)
+		last = now
+		queue.Push(&UpdateEvent{})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sensiblecodeio/barrier"
+)
+
+func TestPoll(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		current = "sha256:aaa"
+		err     error
+	)
+	digest := func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return current, err
+	}
+	set := func(d string, e error) {
+		mu.Lock()
+		defer mu.Unlock()
+		current, err = d, e
+	}
+
+	q := newEventQueue(0)
+	var dying barrier.Barrier
+	defer dying.Fall()
+	go poll("registry", digest, 5*time.Millisecond, q, &dying)
+
+	select {
+	case <-q.Events():
+		t.Fatal("Unexpected deploy while the digest is unchanged")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Errors don't count as a change.
+	set("", errors.New("registry unavailable"))
+	select {
+	case <-q.Events():
+		t.Fatal("Unexpected deploy while the registry is unavailable")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	set("sha256:bbb", nil)
+	select {
+	case ev := <-q.Events():
+		if ev.Manual {
+			t.Errorf("Expected an automatic deploy")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No deploy after the digest changed")
+	}
+
+	select {
+	case <-q.Events():
+		t.Fatal("Unexpected second deploy")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/docker/go-connections/nat"
+)
+
+// portRange is a range of consecutive public ports, published to the same
+// number of consecutive internal ports.
+type portRange struct {
+	Proto    string
+	HostIP   string // blank means all of the host's addresses
+	Public   int
+	Internal int
+	Count    int
+	// Allowed are the source CIDRs which may connect, or nil for any.
+	Allowed []string
+}
+
+// publicPort returns the port on the host which `binding` publishes.
+func publicPort(internalPort nat.Port, binding nat.PortBinding) int {
+	var public int
+	_, err := fmt.Sscan(binding.HostPort, &public)
+	if err != nil {
+		// If no public port specified, use same port as internal port
+		public = internalPort.Int()
+	}
+	return public
+}
+
+// portRanges groups the bindings from --publish into as few ranges as
+// possible, so that e.g. `-p 8000-8010:8000-8010` can be redirected with one
+// rule rather than eleven. `allowed` gives the sources allowed to connect to
+// each public port, from --publish-allow.
+func portRanges(bindings nat.PortMap, allowed map[nat.Port][]string) []portRange {
+	var singles []portRange
+	for internalPort, portBindings := range bindings {
+		for _, binding := range portBindings {
+			public := publicPort(internalPort, binding)
+			key, _ := nat.NewPort(internalPort.Proto(), fmt.Sprint(public))
+
+			hostIP := binding.HostIP
+			if ip := net.ParseIP(hostIP); ip != nil && ip.IsUnspecified() {
+				// Bound to all addresses, as if no host IP were given.
+				hostIP = ""
+			}
+
+			singles = append(singles, portRange{
+				Proto:    internalPort.Proto(),
+				HostIP:   hostIP,
+				Public:   public,
+				Internal: internalPort.Int(),
+				Count:    1,
+				Allowed:  allowed[key],
+			})
+		}
+	}
+
+	sort.Slice(singles, func(i, j int) bool {
+		a, b := singles[i], singles[j]
+		if a.Proto != b.Proto {
+			return a.Proto < b.Proto
+		}
+		if a.HostIP != b.HostIP {
+			return a.HostIP < b.HostIP
+		}
+		if a.Public != b.Public {
+			return a.Public < b.Public
+		}
+		return a.Internal < b.Internal
+	})
+
+	var ranges []portRange
+	for _, single := range singles {
+		if n := len(ranges); n > 0 {
+			last := &ranges[n-1]
+			if last.Proto == single.Proto &&
+				last.HostIP == single.HostIP &&
+				last.Public+last.Count == single.Public &&
+				last.Internal+last.Count == single.Internal &&
+				strings.Join(last.Allowed, ",") == strings.Join(single.Allowed, ",") {
+				last.Count++
+				continue
+			}
+		}
+		ranges = append(ranges, single)
+	}
+	return ranges
+}
+
+func (r portRange) String() string {
+	public := fmt.Sprint(r.Public)
+	internal := fmt.Sprint(r.Internal)
+	if r.Count > 1 {
+		public = fmt.Sprintf("%d-%d", r.Public, r.Public+r.Count-1)
+		internal = fmt.Sprintf("%d-%d", r.Internal, r.Internal+r.Count-1)
+	}
+	if r.HostIP != "" {
+		public = net.JoinHostPort(r.HostIP, public)
+	}
+	return fmt.Sprintf("%s:%s/%s", public, internal, r.Proto)
+}
+
+// parseAllowedSources parses --publish-allow specs of the form
+// `port[/proto]=source[,source...]`, where port may be a range of public
+// ports and each source is an address or CIDR. It returns the sources, as
+// CIDRs, for each public port.
+func parseAllowedSources(specs []string, bindings nat.PortMap) (map[nat.Port][]string, error) {
+	published := map[nat.Port]bool{}
+	for internalPort, portBindings := range bindings {
+		for _, binding := range portBindings {
+			port, _ := nat.NewPort(internalPort.Proto(), fmt.Sprint(publicPort(internalPort, binding)))
+			published[port] = true
+		}
+	}
+
+	allowed := map[nat.Port][]string{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("%q should be of the form port=source[,source...]", spec)
+		}
+
+		proto, ports := nat.SplitProtoPort(parts[0])
+		first, last, err := nat.ParsePortRange(ports)
+		if err != nil {
+			return nil, fmt.Errorf("%q: invalid port %q", spec, parts[0])
+		}
+
+		var sources []string
+		for _, source := range strings.Split(parts[1], ",") {
+			source = strings.TrimSpace(source)
+			if !strings.Contains(source, "/") {
+				// A single address.
+				if ip := net.ParseIP(source); ip != nil && ip.To4() != nil {
+					source += "/32"
+				} else {
+					source += "/128"
+				}
+			}
+			_, n, err := net.ParseCIDR(source)
+			if err != nil {
+				return nil, fmt.Errorf("%q: invalid source %q", spec, source)
+			}
+			sources = append(sources, n.String())
+		}
+
+		for p := first; p <= last; p++ {
+			port, _ := nat.NewPort(proto, fmt.Sprint(p))
+			if !published[port] {
+				return nil, fmt.Errorf("%q: port %v is not published", spec, port)
+			}
+			allowed[port] = append(allowed[port], sources...)
+		}
+	}
+	return allowed, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+)
+
+func TestPortRanges(t *testing.T) {
+	_, bindings, err := nat.ParsePortSpecs([]string{
+		"8000-8010:8000-8010",
+		"127.0.0.1:9000-9001:7000-7001",
+		"53:53/udp",
+		"54:53/udp",
+		"0.0.0.0:80:8080",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := portRanges(bindings, nil)
+	want := []portRange{
+		{Proto: "tcp", Public: 80, Internal: 8080, Count: 1},
+		{Proto: "tcp", Public: 8000, Internal: 8000, Count: 11},
+		{Proto: "tcp", HostIP: "127.0.0.1", Public: 9000, Internal: 7000, Count: 2},
+		{Proto: "udp", Public: 53, Internal: 53, Count: 1},
+		{Proto: "udp", Public: 54, Internal: 53, Count: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestPortRangesAllowedSources(t *testing.T) {
+	_, bindings, err := nat.ParsePortSpecs([]string{"8000-8003:8000-8003"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed, err := parseAllowedSources([]string{
+		"8000-8001=10.0.0.0/8,192.168.1.5",
+		"8003/tcp=2001:db8::/32",
+	}, bindings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := portRanges(bindings, allowed)
+	want := []portRange{
+		{Proto: "tcp", Public: 8000, Internal: 8000, Count: 2,
+			Allowed: []string{"10.0.0.0/8", "192.168.1.5/32"}},
+		{Proto: "tcp", Public: 8002, Internal: 8002, Count: 1},
+		{Proto: "tcp", Public: 8003, Internal: 8003, Count: 1,
+			Allowed: []string{"2001:db8::/32"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	_, err = parseAllowedSources([]string{"9000=10.0.0.0/8"}, bindings)
+	if err == nil {
+		t.Errorf("Expected an error for a port which isn't published")
+	}
+}
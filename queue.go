@@ -0,0 +1,133 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// eventQueue sits between the sources of UpdateEvents (signals, hookbot) and
+// the main loop. Bursts of events are coalesced so that only the most recent
+// is delivered, once no new event has arrived for the debounce window.
+// While held (e.g., while a container is being flipped live), no event is
+// delivered, so that a generation is never superseded mid-flip. While
+// locked, only manual events are delivered. An event coalesced with a manual
+// one is manual too, so that a manual deploy is never lost.
+type eventQueue struct {
+	debounce time.Duration
+
+	in    chan *UpdateEvent
+	out   chan *UpdateEvent
+	holds chan int
+	locks chan bool
+
+	mu              sync.Mutex
+	queued, dropped int
+}
+
+func newEventQueue(debounce time.Duration) *eventQueue {
+	q := &eventQueue{
+		debounce: debounce,
+		in:       make(chan *UpdateEvent),
+		out:      make(chan *UpdateEvent),
+		holds:    make(chan int),
+		locks:    make(chan bool),
+	}
+	go q.run()
+	return q
+}
+
+// Push queues `ev`, replacing any event which has not been delivered yet.
+func (q *eventQueue) Push(ev *UpdateEvent) {
+	q.in <- ev
+}
+
+// Events returns the channel on which coalesced events are delivered.
+func (q *eventQueue) Events() <-chan *UpdateEvent {
+	return q.out
+}
+
+// Hold prevents events from being delivered until Release is called.
+func (q *eventQueue) Hold() { q.holds <- 1 }
+
+// Release undoes one Hold.
+func (q *eventQueue) Release() { q.holds <- -1 }
+
+// SetLocked sets whether automatic deploys are locked. Automatic events
+// arriving while locked are held (the latest replacing any other) and
+// delivered once unlocked.
+func (q *eventQueue) SetLocked(locked bool) { q.locks <- locked }
+
+// Stats returns the number of events which have been queued and the number
+// which were dropped because a newer event replaced them.
+func (q *eventQueue) Stats() (queued, dropped int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.queued, q.dropped
+}
+
+func (q *eventQueue) run() {
+	var (
+		pending  *UpdateEvent
+		settling <-chan time.Time
+		held     int
+		locked   bool
+	)
+
+	for {
+		var out chan<- *UpdateEvent
+		if pending != nil && settling == nil && held == 0 &&
+			(!locked || pending.Manual) {
+			out = q.out
+		}
+
+		select {
+		case ev := <-q.in:
+			q.mu.Lock()
+			q.queued++
+			if pending != nil && pending != ev {
+				q.dropped++
+				// Nothing will ever obtain an image for the dropped event.
+				pending.Obtained.Fall()
+			}
+			queued, dropped := q.queued, q.dropped
+			q.mu.Unlock()
+
+			if pending != nil {
+				log.Printf("Deploy event coalesced with newer event "+
+					"(%d queued, %d dropped)", queued, dropped)
+				if pending.Manual {
+					// The operator's deploy must still happen, so the
+					// newer event takes its place in spite of locks.
+					ev.Manual = true
+				}
+			}
+			if held > 0 {
+				log.Printf("Flip in progress, holding deploy event")
+			}
+			if locked && !ev.Manual {
+				log.Printf("Deploys are locked, holding deploy event")
+			}
+
+			pending = ev
+			settling = time.After(q.debounce)
+
+		case <-settling:
+			settling = nil
+
+		case delta := <-q.holds:
+			held += delta
+			if held == 0 && pending != nil {
+				log.Printf("Deploy event released after flip")
+			}
+
+		case locked = <-q.locks:
+			if !locked && pending != nil {
+				log.Printf("Deploys unlocked, releasing held deploy event")
+			}
+
+		case out <- pending:
+			pending = nil
+		}
+	}
+}
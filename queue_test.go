@@ -0,0 +1,144 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventQueueCoalesces(t *testing.T) {
+	q := newEventQueue(20 * time.Millisecond)
+
+	first, second, third := &UpdateEvent{}, &UpdateEvent{}, &UpdateEvent{}
+	q.Push(first)
+	q.Push(second)
+	q.Push(third)
+
+	select {
+	case ev := <-q.Events():
+		if ev != third {
+			t.Errorf("Expected the latest event to be delivered")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("No event delivered")
+	}
+
+	select {
+	case <-first.Obtained.Barrier():
+	default:
+		t.Errorf("Dropped event should have been released")
+	}
+
+	queued, dropped := q.Stats()
+	if queued != 3 || dropped != 2 {
+		t.Errorf("Expected 3 queued, 2 dropped, got %d, %d", queued, dropped)
+	}
+
+	select {
+	case <-q.Events():
+		t.Errorf("Unexpected second delivery")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestEventQueueHold(t *testing.T) {
+	q := newEventQueue(0)
+
+	q.Hold()
+	ev := &UpdateEvent{}
+	q.Push(ev)
+
+	select {
+	case <-q.Events():
+		t.Fatalf("Event delivered while held")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.Release()
+
+	select {
+	case got := <-q.Events():
+		if got != ev {
+			t.Errorf("Unexpected event delivered")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Event not delivered after release")
+	}
+}
+
+// expectEvent waits for `want` to be delivered by `q`.
+func expectEvent(t *testing.T, q *eventQueue, want *UpdateEvent) {
+	t.Helper()
+	select {
+	case got := <-q.Events():
+		if got != want {
+			t.Errorf("Unexpected event delivered")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Event not delivered")
+	}
+}
+
+// expectNoEvent checks that nothing is delivered by `q` for a while.
+func expectNoEvent(t *testing.T, q *eventQueue) {
+	t.Helper()
+	select {
+	case <-q.Events():
+		t.Fatalf("Unexpected event delivered")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestEventQueueLocked(t *testing.T) {
+	q := newEventQueue(0)
+	q.SetLocked(true)
+
+	// Automatic events are held until unlocked.
+	automatic := &UpdateEvent{}
+	q.Push(automatic)
+	expectNoEvent(t, q)
+	q.SetLocked(false)
+	expectEvent(t, q, automatic)
+
+	// Manual events bypass the lock.
+	q.SetLocked(true)
+	manual := &UpdateEvent{Manual: true}
+	q.Push(manual)
+	expectEvent(t, q, manual)
+}
+
+func TestEventQueueManualThenAutomaticWhileLocked(t *testing.T) {
+	q := newEventQueue(0)
+	q.SetLocked(true)
+
+	// An automatic event arriving before the manual one is delivered
+	// replaces it, but the deploy is still forced.
+	manual := &UpdateEvent{Manual: true}
+	automatic := &UpdateEvent{}
+	q.Push(manual)
+	q.Push(automatic)
+	expectEvent(t, q, automatic)
+	if !automatic.Manual {
+		t.Errorf("Expected the coalesced event to be manual")
+	}
+
+	// Once delivered, later automatic events are held again.
+	later := &UpdateEvent{}
+	q.Push(later)
+	expectNoEvent(t, q)
+	if later.Manual {
+		t.Errorf("Expected a later event not to be manual")
+	}
+}
+
+func TestEventQueueHoldWhileLocked(t *testing.T) {
+	q := newEventQueue(0)
+	q.SetLocked(true)
+	q.Hold()
+
+	// Even a manual event waits for a flip to finish.
+	manual := &UpdateEvent{Manual: true}
+	q.Push(manual)
+	expectNoEvent(t, q)
+	q.Release()
+	expectEvent(t, q, manual)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/sensiblecodeio/hanoverd/pkg/redirect"
+)
+
+// reconcile periodically puts back the live container's firewall rules if
+// they go missing, since nothing tells us when the nat table is rebuilt.
+func reconcile(r redirect.Reconciler, interval time.Duration) {
+	total := 0
+	for range time.Tick(interval) {
+		repaired, err := r.Reconcile()
+		total += repaired
+		if repaired > 0 {
+			log.Printf("Reconcile: repaired %d missing firewall rules (%d in total)",
+				repaired, total)
+		}
+		if err != nil {
+			log.Printf("Reconcile: %v", err)
+		}
+	}
+}